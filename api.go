@@ -2,21 +2,64 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/gurbos/tcd/datastore"
 	ds "github.com/gurbos/tcd/datastore"
+	"github.com/gurbos/tcd/tcapi"
 )
 
 type application struct {
 	store UserDataStore
 }
 
+// DataStoreLifecycle is implemented by data stores that hold resources, such as a connection
+// pool, which must be checked and released by their consumers.
+type DataStoreLifecycle interface {
+	Ping(ctx context.Context) error
+	Close()
+}
+
 type UserDataStore interface {
+	DataStoreLifecycle
 	GetProductLineByName(ctx context.Context, name string) (ds.Product_Line, error)
+	GetProductLineById(ctx context.Context, productLineId int) (ds.Product_Line, error)
 	GetSetsByProductLineId(ctx context.Context, productLineId int) ([]ds.Set, error)
+	GetSetByUrlName(ctx context.Context, urlName string) (ds.Set, int, error)
+	GetSetsReleasedBetween(ctx context.Context, productLineId int, start, end time.Time) ([]ds.Set, error)
+	ListSetsWithStoredCounts(ctx context.Context, productLineId int) ([]ds.SetWithCount, error)
 	GetProductsBySetName(ctx context.Context, setName string) ([]datastore.Product, error)
+	GetProductsBySetIds(ctx context.Context, setIds []int) ([]datastore.Product, error)
+	GetProductByNumber(ctx context.Context, setId int, number string) (datastore.Product, error)
+	GetProductImage(ctx context.Context, productId int) ([]byte, error)
+	GetProductImageIds(ctx context.Context, productIds []int) ([]int, error)
+	EachProduct(ctx context.Context, fn func(datastore.Product) error) error
+	SearchProducts(ctx context.Context, criteria ds.ProductQuery) ([]datastore.Product, error)
+	GetProductsByProductLineId(ctx context.Context, productLineId int) ([]datastore.Product, error)
 	AddProductLine(ctx context.Context, pl *datastore.Product_Line) (*datastore.Product_Line, error)
-	AddSets(ctx context.Context, sets []ds.Set) ([]datastore.Set, error)
+	AddProductLines(ctx context.Context, pls []ds.Product_Line) ([]ds.Product_Line, error)
+	AddSets(ctx context.Context, sets []ds.Set, continueOnError bool) ([]ds.SetResult, error)
 	AddProducts(ctx context.Context, products []datastore.Product) error
 	AddSetData(ctx context.Context, set *datastore.Set, products []datastore.Product) error
+	UpsertSetData(ctx context.Context, set *datastore.Set, products []datastore.Product) error
+	AddProductsForSet(ctx context.Context, setId int, products []datastore.Product) error
+	AddProductImage(ctx context.Context, productId int, data []byte) error
+	UpdateSetCount(ctx context.Context, setId int, count int) error
+}
+
+// ProductFetcher is implemented by sources of TCGPlayer products and product images. The
+// worker pool fetches through it, so the pipeline can run against a stub instead of the API.
+type ProductFetcher interface {
+	FetchProductsInParts(ctx context.Context, sParams tcapi.SearchParams) ([]datastore.Product, tcapi.FetchStats)
+	FetchProductImageById(ctx context.Context, imageId int) ([]byte, error)
+	FetchProductImages(ctx context.Context, ids []int, concurrency int) (map[int][]byte, map[int]error)
 }
+
+// The TCGPlayer API client satisfies ProductFetcher.
+var _ ProductFetcher = (*tcapi.Client)(nil)
+
+// Both data store implementations satisfy UserDataStore.
+var (
+	_ UserDataStore = (*datastore.PostgresDataStore)(nil)
+	_ UserDataStore = (*datastore.InMemoryDataStore)(nil)
+)
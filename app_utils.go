@@ -4,15 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gurbos/tcd/datastore"
 	"github.com/gurbos/tcd/tcapi"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/spf13/pflag"
 )
 
@@ -22,8 +33,16 @@ type DBCredentials struct {
 	host     string
 	port     string
 	dbName   string
+
+	// Optional connection parameters, appended to the connection string when set
+	sslMode         string
+	connectTimeout  string
+	applicationName string
 }
 
+// DEFAULT_APPLICATION_NAME identifies the scraper's connections in pg_stat_activity
+const DEFAULT_APPLICATION_NAME = "tcd"
+
 // LoadCredentials loads database credentials from environment variables.
 func (cred *DBCredentials) LoadCredentials() {
 	var found bool
@@ -47,13 +66,38 @@ func (cred *DBCredentials) LoadCredentials() {
 	if !found {
 		log.Fatal("DB_NAME environment variable not set")
 	}
-}
 
-// ConnectString constructs a PostgreSQL connection string from the credentials.
+	cred.sslMode = os.Getenv("SSL_MODE")
+	cred.connectTimeout = os.Getenv("CONNECT_TIMEOUT")
+	cred.applicationName, found = os.LookupEnv("APPLICATION_NAME")
+	if !found {
+		cred.applicationName = DEFAULT_APPLICATION_NAME
+	}
+}
 
+// ConnectString constructs a PostgreSQL connection string from the credentials. The username,
+// password, and database name are percent-encoded, so they may contain characters such as
+// '@', ':', and '/' that are otherwise significant in a URL. The optional sslmode,
+// connect_timeout, and application_name parameters are added as query parameters when set.
 func (cred *DBCredentials) ConnectString() string {
-	return "postgres://" + cred.username + ":" + cred.password + "@" + cred.host +
-		":" + cred.port + "/" + cred.dbName
+	params := url.Values{}
+	if cred.sslMode != "" {
+		params.Set("sslmode", cred.sslMode)
+	}
+	if cred.connectTimeout != "" {
+		params.Set("connect_timeout", cred.connectTimeout)
+	}
+	if cred.applicationName != "" {
+		params.Set("application_name", cred.applicationName)
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cred.username, cred.password),
+		Host:     net.JoinHostPort(cred.host, cred.port),
+		Path:     "/" + cred.dbName,
+		RawQuery: params.Encode(),
+	}
+	return dsn.String()
 }
 
 // ConnectStringer defines an interface for types that can provide a database connection string.
@@ -61,33 +105,325 @@ type ConnectStringer interface {
 	ConnectString() string
 }
 
-// printLists prints a formatted list of ValueType items in two columns.
-func printLists(list []tcapi.ValueType) {
+// printLists writes a formatted list of ValueType items to w in two columns, sorted by name and
+// limited to items whose name or url name contains filter (case-insensitive). Column widths
+// are sized to the largest index and longest item in the list so the columns stay aligned.
+func printLists(w io.Writer, list []tcapi.ValueType, filter string) {
+	list = filterValueTypes(list, filter)
+	slices.SortFunc(list, func(a, b tcapi.ValueType) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	idxWidth := digits(len(list) - 1)
+	nameWidth := 0
+	for _, elem := range list {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(elem.String())) // fmt pads to a width in runes
+	}
+
 	mid := len(list) / 2
 	for i := 0; i < mid; i++ {
-		fmt.Printf("%-4d : %-60s %-5s %-4d : %-60s\n", i, list[i].Name, "  ", i+mid, list[i+mid].Name)
+		fmt.Fprintf(w, "%-*d : %-*s %-5s %-*d : %s\n",
+			idxWidth, i, nameWidth, list[i], "  ", idxWidth, i+mid, list[i+mid])
 	}
 	if len(list)%2 != 0 {
-		fmt.Printf("%-65s%-60s\n", " ", list[len(list)-1].Name)
+		last := len(list) - 1
+		fmt.Fprintf(w, "%*s%-*d : %s\n", idxWidth+3+nameWidth+7, "", idxWidth, last, list[last])
+	}
+}
+
+// printAggregations writes the card type, rarity, and product type values of a product line
+// to w, each as a list in the format of printLists.
+func printAggregations(w io.Writer, aggs tcapi.ProductLineAggregations, filter string) {
+	lists := []struct {
+		title  string
+		values []tcapi.ValueType
+	}{
+		{"Card types", aggs.CardTypes},
+		{"Rarities", aggs.Rarities},
+		{"Product types", aggs.ProductTypes},
+	}
+	for i, list := range lists {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s:\n", list.title)
+		printLists(w, list.values, filter)
+	}
+}
+
+// printTable writes rows to w as a bordered table with a header row, each column sized to
+// its widest cell.
+func printTable(w io.Writer, headers []string, rows [][]string) {
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = utf8.RuneCountInString(h)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	var border strings.Builder
+	for _, width := range widths {
+		border.WriteString("+" + strings.Repeat("-", width+2))
+	}
+	border.WriteString("+\n")
+
+	printRow := func(row []string) {
+		for i, cell := range row {
+			fmt.Fprintf(w, "| %s%s ", cell, strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+		}
+		fmt.Fprintln(w, "|")
+	}
+
+	fmt.Fprint(w, border.String())
+	printRow(headers)
+	fmt.Fprint(w, border.String())
+	for _, row := range rows {
+		printRow(row)
+	}
+	fmt.Fprint(w, border.String())
+}
+
+// productField is a product field that can be printed as a column of --format output.
+type productField struct {
+	name   string                           // Field name given to --fields
+	header string                           // Column header
+	value  func(p datastore.Product) string // Value of the field for a product
+}
+
+// Product fields accepted by --fields, in the order they are listed in errors and help
+var productFields = []productField{
+	{"id", "Id", func(p datastore.Product) string { return strconv.Itoa(p.ProductId) }},
+	{"number", "Number", func(p datastore.Product) string { return p.ProductNumber }},
+	{"name", "Name", func(p datastore.Product) string { return p.ProductName }},
+	{"rarity", "Rarity", func(p datastore.Product) string { return p.RarityName }},
+	{"releaseDate", "Release Date", func(p datastore.Product) string {
+		if p.ReleasedOn.IsZero() {
+			return p.ReleaseDate // Kept as given when it couldn't be parsed
+		}
+		return p.ReleasedOn.Format(time.DateOnly)
+	}},
+	{"set", "Set", func(p datastore.Product) string { return p.SetUrlName }},
+	{"productLine", "Product Line", func(p datastore.Product) string { return p.ProductLineUrlName }},
+}
+
+// Columns of --format output when --fields isn't given
+var defaultProductFields = []string{"number", "name", "rarity"}
+
+// productFieldNames returns the names of the fields accepted by --fields.
+func productFieldNames() []string {
+	names := make([]string, len(productFields))
+	for i, field := range productFields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// parseProductFields returns the product fields named by names, in the order given, or an error
+// listing the valid field names if a name is unknown. Names are matched ignoring case.
+func parseProductFields(names []string) ([]productField, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Invalid --fields, at least one of %s is required", strings.Join(productFieldNames(), ", "))
+	}
+	fields := make([]productField, 0, len(names))
+	for _, name := range names {
+		i := slices.IndexFunc(productFields, func(f productField) bool { return strings.EqualFold(f.name, strings.TrimSpace(name)) })
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid --fields name '%s', valid fields are: %s", name, strings.Join(productFieldNames(), ", "))
+		}
+		fields = append(fields, productFields[i])
 	}
+	return fields, nil
+}
+
+// printProductTable prints the set name followed by a table of the fields of each of its
+// products, one column per field in order.
+func printProductTable(w io.Writer, set datastore.Set, products []datastore.Product, fields []productField) {
+	headers := make([]string, len(fields))
+	for i, field := range fields {
+		headers[i] = field.header
+	}
+	rows := make([][]string, len(products))
+	for i, p := range products {
+		rows[i] = make([]string, len(fields))
+		for j, field := range fields {
+			rows[i][j] = field.value(p)
+		}
+	}
+	fmt.Fprintf(w, "%s (%d products)\n", set.Name, len(products))
+	printTable(w, headers, rows)
+	fmt.Fprintln(w)
+}
+
+// filterValueTypes returns a copy of the items whose name or url name contains filter,
+// ignoring case. An empty filter matches every item.
+func filterValueTypes(list []tcapi.ValueType, filter string) []tcapi.ValueType {
+	filter = strings.ToLower(filter)
+	var filtered []tcapi.ValueType
+	for _, elem := range list {
+		if strings.Contains(strings.ToLower(elem.Name), filter) || strings.Contains(strings.ToLower(elem.UrlName), filter) {
+			filtered = append(filtered, elem)
+		}
+	}
+	return filtered
+}
+
+// digits returns the number of characters needed to print n in base 10.
+func digits(n int) int {
+	return len(strconv.Itoa(n))
+}
+
+// setLineFormat returns the format string used by statusWorker to print a completed set
+// (set id, set name, product count), with each column sized to fit every set in the list. The
+// id column fits the largest set id and the largest index into the list, since sets that
+// aren't stored yet have no id and printSetCounts prints indexes in its place.
+func setLineFormat(sets []datastore.Set) string {
+	idWidth, nameWidth, countWidth := digits(max(len(sets)-1, 0)), 0, 0
+	for _, set := range sets {
+		idWidth = max(idWidth, digits(set.Id))
+		nameWidth = max(nameWidth, utf8.RuneCountInString(set.Name))
+		countWidth = max(countWidth, digits(set.Count))
+	}
+	return fmt.Sprintf("%%-%dd %%-%ds %%%dd\n", idWidth, nameWidth, countWidth)
+}
+
+// productLineNotFoundError returns an error for an unknown product line name that lists
+// the url names of the available product lines.
+func productLineNotFoundError(name string, productLines []tcapi.ValueType) error {
+	urlNames := make([]string, len(productLines))
+	for i, pl := range productLines {
+		urlNames[i] = pl.UrlName
+	}
+	return fmt.Errorf("Product line '%s' not found, valid product lines are: %s", name, strings.Join(urlNames, ", "))
 }
 
 type cmd_flags struct {
-	product_lines     bool
-	product_line_name string
-	sets              bool
-	write_data        bool
-	pl                string
+	product_lines        bool
+	product_line_names   []string
+	sets                 bool
+	write_data           bool
+	pl                   string
+	quiet                bool
+	query_timeout        time.Duration
+	exact_set_name       bool
+	conn_lifetime_jitter time.Duration
+	force_images         bool
+	audit_attributes     bool
+	capture_raw          bool
+	image_size           string
+	image_format         string
+	filter               string
+	limit                int
+	image_file_mode      string
+	image_dir_mode       string
+	resume               bool
+	product_type         string
+	cache_dir            string
+	cache_ttl            time.Duration
+	count_only           bool
+	metrics_addr         string
+	version              bool
+	batch_size           int
+	workers              int
+	data_workers         int
+	job_workers          int
+	image_workers        int
+	image_store          string
+	sort                 string
+	rarities             []string
+	shipping_country     string
+	set                  string
+	proxy                string
+	image_dir            string
+	config               string
+	image_path           string
+	check_db             bool
+	upsert               bool
+	refresh_counts       bool
+	format               string
+	fields               []string
+	list_aggregations    bool
+	fail_fast            bool
+	audit_log            string
+	since                string
+	headers              []string
+	debug_http           bool
+	search_timeout       time.Duration
+	image_timeout        time.Duration
 }
 
 func initCmdFlags() *cmd_flags {
 	var flags cmd_flags
 	pflag.BoolVarP(&flags.product_lines, "product-lines", "p", false, "Fetch all product lines from the data source")
 	pflag.BoolVarP(&flags.sets, "sets", "s", false, "Specify sets as target data")
-	pflag.StringVarP(&flags.product_line_name, "product-line-name", "n", "", "Product line name to process data for")
+	pflag.StringSliceVarP(&flags.product_line_names, "product-line-name", "n", nil, "Product line url or display names to process data for, comma-separated or repeated")
 	pflag.BoolVarP(&flags.write_data, "write-data", "", false, "Write product line products and sets to the database")
 	pflag.StringVarP(&flags.pl, "pl", "", "yugioh", "Product line to fetch sets for")
+	pflag.BoolVarP(&flags.quiet, "quiet", "q", false, "Suppress periodic progress reports")
+	pflag.DurationVarP(&flags.query_timeout, "query-timeout", "", datastore.DefaultQueryTimeout, "Timeout for each database operation (0 disables)")
+	pflag.BoolVarP(&flags.exact_set_name, "no-fuzzy-setname", "", false, "Keep only products whose set url name exactly matches the requested set")
+	pflag.DurationVarP(&flags.conn_lifetime_jitter, "conn-lifetime-jitter", "", datastore.DefaultMaxConnLifetimeJitter, "Maximum random duration added to each database connection's lifetime")
+	pflag.BoolVarP(&flags.force_images, "force-images", "", false, "Re-download images that are already stored, on disk or, with --resume, in the database")
+	pflag.BoolVarP(&flags.audit_attributes, "audit-attributes", "", false, "Report stored products whose custom attributes fail to parse or lack expected keys")
+	pflag.BoolVarP(&flags.capture_raw, "capture-raw", "", false, "Store the entire upstream JSON of each product")
+	pflag.StringVarP(&flags.image_size, "image-size", "", tcapi.DEFAULT_IMAGE_SIZE, "Size of product images to fetch ("+strings.Join(tcapi.ImageSizes, ", ")+")")
+	pflag.StringVarP(&flags.image_format, "image-format", "", tcapi.DEFAULT_IMAGE_FORMAT, "Format of product images to fetch ("+strings.Join(tcapi.ImageFormats, ", ")+")")
+	pflag.StringVarP(&flags.filter, "filter", "", "", "Only list items whose name contains this substring")
+	pflag.IntVarP(&flags.limit, "limit", "", 0, "Maximum number of sets to process (0 means no limit)")
+	pflag.StringVarP(&flags.image_file_mode, "image-file-mode", "", "0644", "Octal permissions of written image files")
+	pflag.StringVarP(&flags.image_dir_mode, "image-dir-mode", "", "0755", "Octal permissions of created image directories")
+	pflag.BoolVarP(&flags.resume, "resume", "", false, "Skip sets already stored with their expected product count; "+
+		"with --upsert and a non-empty --sort, sets that grew since they were stored are fetched from their stored product count. "+
+		"A set interrupted while scraping stores no products, so it is fetched again from the start. "+
+		"With --image-store db, products whose image is already stored are skipped unless --force-images is set")
+	pflag.StringVarP(&flags.product_type, "product-type", "", "Cards", "Product type to scrape")
+	pflag.StringVarP(&flags.cache_dir, "cache-dir", "", "", "Cache TCGPlayer API search responses in this directory")
+	pflag.DurationVarP(&flags.search_timeout, "search-timeout", "", tcapi.DEFAULT_SEARCH_TIMEOUT, "Timeout for each TCGPlayer API search request (0 disables)")
+	pflag.DurationVarP(&flags.image_timeout, "image-timeout", "", tcapi.DEFAULT_IMAGE_TIMEOUT, "Timeout for each product image request (0 disables)")
+	pflag.DurationVarP(&flags.cache_ttl, "cache-ttl", "", 24*time.Hour, "Maximum age of cached search responses")
+	pflag.BoolVarP(&flags.count_only, "count-only", "", false, "Print the product count of each set and exit without scraping")
+	pflag.StringVarP(&flags.metrics_addr, "metrics-addr", "", "", "Serve Prometheus metrics at /metrics on this address, e.g. :9090 (disabled if empty)")
+	pflag.IntVarP(&flags.batch_size, "batch-size", "", datastore.DefaultBatchSize, "Maximum number of products inserted in a single database batch (0 disables chunking)")
+	pflag.IntVarP(&flags.workers, "workers", "", 0, "Number of workers in each stage of the pool (0 uses GOMAXPROCS/3); "+
+		"each data worker issues its own TCGPlayer API requests, so more workers means more concurrent requests")
+	pflag.IntVarP(&flags.data_workers, "data-workers", "", 0, "Number of workers fetching products from the TCGPlayer API (0 uses --workers)")
+	pflag.IntVarP(&flags.job_workers, "job-workers", "", 0, "Number of workers writing sets to the database (0 uses --workers)")
+	pflag.IntVarP(&flags.image_workers, "image-workers", "", 0, "Number of workers fetching product images (0 uses --workers plus 2)")
+	pflag.StringVarP(&flags.image_store, "image-store", "", IMAGE_STORE_FILES, "Where to store product images ("+IMAGE_STORE_FILES+" or "+IMAGE_STORE_DB+")")
+	pflag.StringVarP(&flags.sort, "sort", "", tcapi.DEFAULT_SCRAPE_SORT, "Order in which products are fetched ("+strings.Join(tcapi.SortOptions, ", ")+"); "+
+		"an empty sort uses the API's relevance order, which isn't stable across pages")
+	pflag.StringSliceVarP(&flags.rarities, "rarity", "", nil, "Only scrape products of these rarities, comma-separated or repeated")
+	pflag.StringVarP(&flags.shipping_country, "shipping-country", "", tcapi.DEFAULT_SHIPPING_COUNTRY, "Two-letter code of the country search prices are quoted for")
+	pflag.StringVarP(&flags.set, "set", "", "", "Url name of the single set to scrape from the product line")
+	pflag.StringVarP(&flags.proxy, "proxy", "", "", "Proxy URL for TCGPlayer API requests, overriding HTTP_PROXY and HTTPS_PROXY")
+	pflag.StringVarP(&flags.image_dir, "image-dir", "", CARD_IMAGE_DIR, "Directory product image files are written to")
+	pflag.StringVarP(&flags.image_path, "image-path", "", DEFAULT_IMAGE_PATH, "Template of image file paths within --image-dir, e.g. {productLine}/{set}/{number}.{format}; "+
+		"placeholders are "+strings.Join(imagePathPlaceholders, ", "))
+	pflag.BoolVarP(&flags.check_db, "check-db", "", false, "Connect to the database, run a test query, report the result, and exit")
+	pflag.StringVarP(&flags.config, "config", "", "", "TOML file of settings; flags given on the command line override its values")
+	pflag.BoolVarP(&flags.upsert, "upsert", "", false, "Also scrape sets already stored, updating their stored products instead of skipping them")
+	pflag.BoolVarP(&flags.refresh_counts, "refresh-counts", "", false, "Update the stored card counts of the product line's sets and exit without scraping")
+	pflag.StringVarP(&flags.format, "format", "", "", "Print scraped products to stdout instead of writing them to the database ("+FORMAT_TABLE+")")
+	pflag.StringSliceVarP(&flags.fields, "fields", "", defaultProductFields, "Product fields printed as the columns of --format output, in order, comma-separated ("+
+		strings.Join(productFieldNames(), ", ")+")")
+	pflag.StringArrayVarP(&flags.headers, "header", "", nil, "Header added to TCGPlayer API requests, replacing the default of the same name, as 'Name: value'; "+
+		"repeat for several headers, an empty value removes the header")
+	pflag.BoolVarP(&flags.debug_http, "debug-http", "", false, "Log each TCGPlayer API request and response, with bodies cut to 4 KiB")
+	pflag.StringVarP(&flags.since, "since", "", "", "Only scrape sets released after this date (YYYY-MM-DD)")
+	pflag.StringVarP(&flags.audit_log, "audit-log", "", "", "Append a JSON line recording the products written for each set to this file")
+	pflag.BoolVarP(&flags.fail_fast, "fail-fast", "", false, "Stop the scrape at the first set or product line that fails instead of continuing past it")
+	pflag.BoolVarP(&flags.list_aggregations, "list-aggregations", "", false, "List the card types, rarities, and product types of the --pl product line")
+	pflag.BoolVarP(&flags.version, "version", "", false, "Print version and build information and exit")
 	pflag.Parse()
+
+	// Fill in flags not given on the command line from the config file
+	if flags.config != "" {
+		if err := loadConfigFile(flags.config, pflag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+	}
 	return &flags
 }
 
@@ -104,20 +440,33 @@ func assocProductsWithSetAndProductLine(products []datastore.Product, setId int,
 	}
 }
 
-// screenProducts removes products without a ProductNumber and eliminates duplicates.
-func screenProducts(producsts []datastore.Product) []datastore.Product {
-	products := removeProductWithoutNumber(producsts)
-	products = removeDuplicateProducts(products)
-	return products
+// screenProducts removes products without a ProductNumber and eliminates duplicates, keeping the
+// first occurrence of each. It returns the screened products along with the number of products
+// dropped for lacking a ProductNumber and the number dropped as duplicates.
+func screenProducts(products []datastore.Product) (screened []datastore.Product, noNumber int, duplicates int) {
+	screened = removeProductWithoutNumber(products)
+	noNumber = len(products) - len(screened)
+	numbered := len(screened)
+	screened = removeDuplicateProducts(screened)
+	return screened, noNumber, numbered - len(screened)
+}
+
+// productKey identifies a product within a set. The same ProductNumber may
+// legitimately appear in different sets.
+type productKey struct {
+	setId         int
+	productNumber string
 }
 
-// removeDuplicateProducts removes duplicate products based on ProductNumber.
+// removeDuplicateProducts removes duplicate products based on SetId and ProductNumber,
+// so products sharing a number across sets are kept.
 func removeDuplicateProducts(products []datastore.Product) []datastore.Product {
-	seen := make(map[string]struct{})
+	seen := make(map[productKey]struct{})
 	unique := []datastore.Product{}
 	for _, p := range products {
-		if _, exists := seen[p.ProductNumber]; !exists {
-			seen[p.ProductNumber] = struct{}{}
+		key := productKey{setId: p.SetId, productNumber: p.ProductNumber}
+		if _, exists := seen[key]; !exists {
+			seen[key] = struct{}{}
 			unique = append(unique, p)
 		}
 	}
@@ -135,90 +484,224 @@ func removeProductWithoutNumber(products []datastore.Product) []datastore.Produc
 	return filtered
 }
 
-// removeProductByProductNumber removes a product with the specified ProductNumber from the list.
-func removeProductByProductNumber(products []datastore.Product, number string) []datastore.Product {
-	filtered := make([]datastore.Product, len(products)-1)
-	var i int // index of element to remove
-	for i = 0; i < len(products); i++ {
-		if products[i].ProductNumber != number {
-			filtered = append(filtered, products[i])
+// filterProductsBySetUrlName keeps only the products whose SetUrlName exactly matches setUrlName,
+// removing products pulled in from similarly named sets by fuzzy search. It returns the filtered
+// list and the number of products removed.
+func filterProductsBySetUrlName(products []datastore.Product, setUrlName string) ([]datastore.Product, int) {
+	var filtered []datastore.Product
+	for _, p := range products {
+		if strings.EqualFold(p.SetUrlName, setUrlName) {
+			filtered = append(filtered, p)
 		}
 	}
-	return filtered
+	return filtered, len(products) - len(filtered)
 }
 
-// getProductIdByName retrieves the ProductId of a product by its name.
-func getProductIdByName(products []datastore.Product, name string) int {
+// earliestRelease returns the raw and parsed release date of the earliest released product.
+// Parsed dates are compared when any product has one; otherwise the earliest non-empty raw
+// ReleaseDate is returned with a zero time.
+func earliestRelease(products []datastore.Product) (string, time.Time) {
+	var earliest string
+	var earliestOn time.Time
 	for _, p := range products {
-		if p.ProductName == name {
-			return p.ProductId
+		switch {
+		case !p.ReleasedOn.IsZero():
+			if earliestOn.IsZero() || p.ReleasedOn.Before(earliestOn) {
+				earliest, earliestOn = p.ReleaseDate, p.ReleasedOn
+			}
+		case earliestOn.IsZero() && p.ReleaseDate != "" && (earliest == "" || p.ReleaseDate < earliest):
+			earliest = p.ReleaseDate
+		}
+	}
+	return earliest, earliestOn
+}
+
+// removeProductByProductNumber removes the products with the specified ProductNumber from the
+// list, returning the remaining products and the number removed. An empty number removes nothing.
+func removeProductByProductNumber(products []datastore.Product, number string) ([]datastore.Product, int) {
+	if number == "" {
+		return products, 0
+	}
+	filtered := make([]datastore.Product, 0, len(products))
+	for _, p := range products {
+		if p.ProductNumber != number {
+			filtered = append(filtered, p)
 		}
 	}
-	return 0
+	return filtered, len(products) - len(filtered)
+}
+
+// productsByNumber maps the ProductNumber of each product to the product. Product numbers
+// are unique within a set, unlike product names.
+func productsByNumber(products []datastore.Product) map[string]datastore.Product {
+	byNumber := make(map[string]datastore.Product, len(products))
+	for _, p := range products {
+		byNumber[p.ProductNumber] = p
+	}
+	return byNumber
 }
 
 // dataWorker fetches products, based search parameters sent via the data context channel, from
 // the TCGPlayer API, initializes a jobs with the fetched products, and sends the jobs, via the jobs channel,
 // to the job workers for processing.
-func dataWorker(id int, ctx context.Context, dcChan <-chan DataContext, jobsChan chan<- Job, wg *sync.WaitGroup) {
+func dataWorker(id int, ctx context.Context, dcChan <-chan DataContext, jobsChan chan<- Job, wg *sync.WaitGroup,
+	pending *sync.WaitGroup, client ProductFetcher, progress *Progress, exactSetName bool, failFast context.CancelCauseFunc) {
 	defer wg.Done()
 	for {
-		dc, open := <-dcChan
+		var dc DataContext
+		var open bool
+		select {
+		case dc, open = <-dcChan:
+		case <-ctx.Done():
+			return // Data contexts left in the channel are counted when the pool is drained
+		}
 		if !open {
 			//fmt.Printf("\nData Worker %d: No more data contexts to process. Exiting.\n\n", id)
 			return
 		}
-		products := tcapi.FetchProductsInParts(dc.searchParams) // Fetch products based on search parameters
+		// Stop without fetching if the scrape was canceled while receiving
+		if ctx.Err() != nil {
+			progress.SetNotProcessed()
+			return
+		}
+		products, fetchStats := client.FetchProductsInParts(ctx, dc.searchParams) // Fetch products based on search parameters
+		progress.ApiCalls(fetchStats)
+		metricApiRequests.Add(int64(fetchStats.Calls))
+		metricProductsFetched.Add(int64(len(products)))
+		if fetchStats.SchemaErr != nil {
+			log.Printf("Data Worker %d: WARNING: set '%s': %v\n", id, dc.set.Name, fetchStats.SchemaErr)
+		}
+		if fetchStats.Err != nil && ctx.Err() != nil { // Canceled while fetching, not a failure of the set
+			progress.SetNotProcessed()
+			return
+		}
+		if fetchStats.Err != nil { // Fail the set rather than store it with products missing
+			log.Printf("Data Worker %d: Set '%s' failed: %v\n", id, dc.set.Name, fetchStats.Err)
+			failSet(&dc.set, fetchStats.Err, progress, failFast)
+			continue
+		}
+		if fetchStats.Exceeded() {
+			log.Printf("Data Worker %d: Set '%s' took %d API calls, expected %d\n",
+				id, dc.set.Name, fetchStats.Calls, fetchStats.ExpectedCalls)
+		}
 		if len(products) == 0 {
 			fmt.Printf("\nData Worker %d: No products found for set '%s'. Skipping.\n\n", id, dc.set.Name)
+			progress.SetEmpty()
 			continue
 		}
-		products = screenProducts(products)       // Screen products to remove those without ProductNumber and duplicates
-		dc.UpdateSetCount(len(products))          // Update set count with number of products after screening
+		if exactSetName {
+			var dropped int
+			products, dropped = filterProductsBySetUrlName(products, dc.set.UrlName)
+			if dropped > 0 {
+				log.Printf("Data Worker %d: Dropping %d products from other sets matched by set '%s'\n", id, dropped, dc.set.Name)
+			}
+		}
+		assocProductsWithSetAndProductLine(products, dc.set.Id, dc.productLine.Id) // Associate first so duplicates are keyed by set
+		fetched := len(products)
+		products, noNumber, duplicates := screenProducts(products) // Screen products to remove those without ProductNumber and duplicates
+		if noNumber+duplicates > 0 {
+			log.Printf("Data Worker %d: Set '%s' kept %d of %d products, dropped %d without a product number and %d duplicates\n",
+				id, dc.set.Name, len(products), fetched, noNumber, duplicates)
+		}
+		metricProductsDup.Add(int64(duplicates))
+		dc.UpdateSetCount(dc.searchParams.From + len(products)) // Update set count with number of products after screening
+		// Set release date is the earliest product release date, including the stored products of a resumed set
+		release, releasedOn := earliestRelease(products)
+		if dc.searchParams.From == 0 || dc.set.ReleasedOn.IsZero() || (!releasedOn.IsZero() && releasedOn.Before(dc.set.ReleasedOn)) {
+			dc.set.ReleaseDate, dc.set.ReleasedOn = release, releasedOn
+		}
 		dc.UpdateSearchResultsSize(len(products)) // Update set count with number of products after screening
-		assocProductsWithSetAndProductLine(products, dc.set.Id, dc.productLine.Id)
 		job := NewJob(dc.productLine, dc.set, products)
-		jobsChan <- job
+		jobStarted(pending)
+		select {
+		case jobsChan <- job:
+		case <-ctx.Done():
+			jobFinished(pending)
+			progress.SetNotProcessed()
+			return
+		}
 	}
 }
 
 // jobWorker processes jobs, received via the jobs channel, and adds them to the database using the
 // provided UserDataStore. It reports job status, via the job status channel, to the status worker.
-func jobWorker(id int, ctx context.Context, jobsChan <-chan Job, statChan chan<- JobStatus, wg *sync.WaitGroup, store UserDataStore) {
+func jobWorker(id int, ctx context.Context, jobsChan <-chan Job, statChan chan<- JobStatus, wg *sync.WaitGroup,
+	pending *sync.WaitGroup, store UserDataStore, progress *Progress, upsert bool, audit *auditLog) {
 	defer wg.Done()
 
+	// Write set data with UpsertSetData if upsert is set, so stored sets are refreshed
+	addSetData := store.AddSetData
+	if upsert {
+		addSetData = store.UpsertSetData
+	}
+
 	// Process jobs from the jobs channel
 	for {
-		job, open := <-jobsChan
+		var job Job
+		var open bool
+		select {
+		case job, open = <-jobsChan:
+		case <-ctx.Done():
+			return // Jobs left in the channel are counted when the pool is drained
+		}
 		// End worker if jobs channel is closed
 		if !open {
 			//fmt.Printf("Job Worker %d: No more jobs to process. Exiting.\n", id)
 			return
 		}
+		// Stop without writing if the scrape was canceled while receiving
+		if ctx.Err() != nil {
+			jobFinished(pending)
+			progress.SetNotProcessed()
+			return
+		}
 
-		jobStatus := JobStatus{job: &job}                      // Initialize job status
-		err := store.AddSetData(ctx, job.set, job.productList) // attempt to add products to the database
+		jobStatus := JobStatus{job: &job}                // Initialize job status
+		err := addSetData(ctx, job.set, job.productList) // attempt to add products to the database
 		if err != nil {
 			jobStatus.success = false // Mark job as failed
+			metricJobsFailed.Add(1)
 		} else {
 			jobStatus.success = true // Mark job as successful
+			if audit != nil {
+				if err := audit.Record(job.productLine.UrlName, job.set, job.productList); err != nil {
+					log.Printf("Job Worker %d: %v", id, err)
+				}
+			}
 		}
 		jobStatus.err = err // Record any error encountered
 		jobStatus.worker = id
-		statChan <- jobStatus // Send job status to status channel
+		select {
+		case statChan <- jobStatus: // Send job status to status channel
+		case <-ctx.Done():
+			abandonStatus(progress, pending, jobStatus)
+			return
+		}
 	}
 }
 
 // imageWorker fetches and stores images for products received via the jobs channel.
-func imageWorker(id int, ctx context.Context, imgIdChan chan []datastore.Product, wg *sync.WaitGroup, store UserDataStore) {
+func imageWorker(id int, ctx context.Context, imgIdChan chan []datastore.Product, wg *sync.WaitGroup, store UserDataStore,
+	progress *Progress, opts ImageOptions) {
 	defer wg.Done()
 
 	// Fetch and store images for products from the image ID channel.
 	// Images are fetched using the product Id assigned by the TCGPlayer API,
 	// then renamed using the product id assigned by the user data store.
 	for {
-		prodList, open := <-imgIdChan
+		var prodList []datastore.Product
+		var open bool
+		select {
+		case prodList, open = <-imgIdChan:
+		case <-ctx.Done():
+			return // Image requests left in the channel are counted when the pool is drained
+		}
 		if open {
+			// Stop without fetching if the scrape was canceled while receiving
+			if ctx.Err() != nil {
+				progress.ImagesNotFetched()
+				return
+			}
 			setName := prodList[0].SetName
 			products, err := store.GetProductsBySetName(ctx, setName) // Get list of products for the specified set from user data store
 			if err != nil {
@@ -227,20 +710,14 @@ func imageWorker(id int, ctx context.Context, imgIdChan chan []datastore.Product
 			}
 
 			// Fetch and store images for each product in the job using the product Id from user data store
-			imgFiles := make(map[string][]byte) // Map to hold image file data
-			for _, elem := range prodList {
-				imgData, err := tcapi.FetchProductImageById(ctx, elem.ProductId) // Fetch product image by product Id
-				if err != nil {
-					log.Printf("Error fetching image for product %s: %v\n", elem.ProductName, err)
-					continue
-				}
-				id := getProductIdByName(products, elem.ProductName)                                 // Get product Id from product list from user data store
-				fileName := fmt.Sprintf("%s%d_in_%s", CARD_IMAGE_DIR, id, tcapi.IMAGE_FORMAT_SUFFIX) // Construct file name using product Id
-				imgFiles[fileName] = imgData                                                         // Store image data in map
-			}
-			for fileName, imgData := range imgFiles {
-				err = os.WriteFile(fileName, imgData, 0644) // Save image data to file
-				if err != nil {
+			res := fetchSetImages(ctx, store, prodList, products, opts)
+			log.Printf("Images for set %s: %d fetched, %d skipped, %d failed, %d unmatched\n",
+				setName, res.fetched, res.skipped, res.failed, res.unmatched)
+			metricImagesFetched.Add(int64(res.fetched))
+			metricImagesFailed.Add(int64(res.failed))
+			progress.ImagesFailed(res.failedIds)
+			for _, img := range res.images {
+				if err := storeImage(ctx, store, opts, img.product, img.data); err != nil {
 					log.Printf("Error saving image in set %s: %v\n", setName, err)
 				}
 			}
@@ -252,41 +729,388 @@ func imageWorker(id int, ctx context.Context, imgIdChan chan []datastore.Product
 	//fmt.Printf("Images Worker %d: No more images to fetch. Exiting.\n", id)
 }
 
+// ImageOptions holds configuration for fetching and storing product images.
+type ImageOptions struct {
+	force    bool            // Re-download images that already exist on disk
+	resume   bool            // Skip products with an image stored in the product_images table
+	client   ProductFetcher  // Fetcher used to fetch images in the size and format of spec
+	spec     tcapi.ImageSpec // Size and format of fetched images
+	fileMode os.FileMode     // Permissions of written image files
+	dirMode  os.FileMode     // Permissions of created image directories
+	store    string          // Where images are stored, IMAGE_STORE_FILES or IMAGE_STORE_DB
+	dir      string          // Directory image files are written to when store is IMAGE_STORE_FILES
+	path     string          // Image path template, relative to dir, expanded by imageFileName
+}
+
+// Placeholders accepted in image path templates, each replaced by imageFileName with a field
+// of the stored product or the image spec
+var imagePathPlaceholders = []string{"{id}", "{productLine}", "{set}", "{number}", "{rarity}", "{suffix}", "{format}"}
+
+// validateImagePath returns an error if the image path template has an unknown placeholder or
+// isn't a relative path within the image directory.
+func validateImagePath(template string) error {
+	rest := template
+	for _, placeholder := range imagePathPlaceholders {
+		rest = strings.ReplaceAll(rest, placeholder, "x")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("Invalid image path '%s', placeholders are: %s", template, strings.Join(imagePathPlaceholders, ", "))
+	}
+	if !filepath.IsLocal(rest) {
+		return fmt.Errorf("Invalid image path '%s', must be a relative path within the image directory", template)
+	}
+	return nil
+}
+
+// pathElement returns s escaped for use within a single path element. Path separators and
+// control characters are replaced with '-', and an element of only dots, which would refer to a
+// directory, is prefixed with '_'.
+func pathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '-'
+		}
+		return r
+	}, s)
+	if s != "" && strings.Trim(s, ".") == "" {
+		s = "_" + s
+	}
+	return s
+}
+
+// imageFileName returns the path of the image file for the stored product p, expanding the
+// opts.path template under opts.dir. Product fields are escaped with pathElement so each stays
+// within a single path element.
+func imageFileName(p datastore.Product, opts ImageOptions) string {
+	path := strings.NewReplacer(
+		"{id}", strconv.Itoa(p.ProductId),
+		"{productLine}", pathElement(p.ProductLineUrlName),
+		"{set}", pathElement(p.SetUrlName),
+		"{number}", pathElement(p.ProductNumber),
+		"{rarity}", pathElement(p.RarityName),
+		"{suffix}", opts.spec.Suffix(),
+		"{format}", opts.spec.Format,
+	).Replace(opts.path)
+	return filepath.Join(opts.dir, path)
+}
+
+// storeImage saves image data for the stored product p, either as a file under opts.dir or in
+// the user data store, depending on opts.store.
+func storeImage(ctx context.Context, store UserDataStore, opts ImageOptions, p datastore.Product, imgData []byte) error {
+	if opts.store == IMAGE_STORE_DB {
+		return store.AddProductImage(ctx, p.ProductId, imgData)
+	}
+
+	fileName := imageFileName(p, opts)
+	if err := os.MkdirAll(filepath.Dir(fileName), opts.dirMode); err != nil { // Create image directory if needed
+		return fmt.Errorf("Error creating image directory: %w", err)
+	}
+	if err := os.WriteFile(fileName, imgData, opts.fileMode); err != nil { // Save image data to file
+		return fmt.Errorf("Error writing image file: %w", err)
+	}
+	return nil
+}
+
+// parseFileMode parses an octal file mode string such as "0644".
+func parseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid file mode '%s', expected octal permissions such as 0644", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// productImage holds the image data fetched for a product stored in the user data store.
+type productImage struct {
+	product datastore.Product
+	data    []byte
+}
+
+// imageFetchResult holds the images fetched for a set's stored products, and counts of the
+// images fetched, skipped because they already exist, failed, and not fetched because the
+// product has no stored match.
+type imageFetchResult struct {
+	images    []productImage
+	fetched   int
+	skipped   int
+	failed    int
+	unmatched int
+	failedIds []int // TCGPlayer product Ids whose image could not be fetched after all attempts
+}
+
+// fetchSetImages concurrently fetches the images for the products of a single set, with at most
+// IMAGE_FETCH_CONCURRENCY requests in flight. Failed fetches are retried with backoff up to
+// IMAGE_FETCH_ATTEMPTS attempts in total. Images are keyed by the product id of the user data
+// store product with the same product number; products without a match are logged and skipped.
+// When storing images as files, images whose file already exists are skipped unless opts.force is set.
+// When storing images in the data store and resuming, products with an image already stored are
+// skipped unless opts.force is set, looked up with a single query rather than one per product.
+func fetchSetImages(ctx context.Context, store UserDataStore, prodList []datastore.Product, products []datastore.Product,
+	opts ImageOptions) imageFetchResult {
+	var res imageFetchResult
+	storedById := make(map[int]datastore.Product) // User data store products keyed by TCGPlayer product Id
+	var ids []int
+
+	stored := productsByNumber(products) // Products from user data store keyed by product number
+	recorded := make(map[int]bool)       // User data store product ids with an image stored
+	if opts.resume && !opts.force && opts.store == IMAGE_STORE_DB {
+		storedIds := make([]int, 0, len(products))
+		for _, p := range products {
+			storedIds = append(storedIds, p.ProductId)
+		}
+		imageIds, err := store.GetProductImageIds(ctx, storedIds)
+		if err != nil {
+			log.Printf("Error checking stored images, fetching every image: %v\n", err)
+		}
+		for _, id := range imageIds {
+			recorded[id] = true
+		}
+	}
+	for _, elem := range prodList {
+		storedProduct, ok := stored[elem.ProductNumber] // Get product from product list from user data store
+		if !ok {
+			log.Printf("No stored product matches product %d '%s' number '%s' in set %s\n",
+				elem.ProductId, elem.ProductName, elem.ProductNumber, elem.SetName)
+			res.unmatched++
+			continue
+		}
+		if !opts.force && opts.store != IMAGE_STORE_DB {
+			if _, err := os.Stat(imageFileName(storedProduct, opts)); err == nil {
+				res.skipped++ // Image already exists on disk
+				continue
+			}
+		}
+		if recorded[storedProduct.ProductId] {
+			res.skipped++ // Image already stored by an earlier run
+			continue
+		}
+		storedById[elem.ProductId] = storedProduct
+		ids = append(ids, elem.ProductId)
+	}
+
+	images, errs := opts.client.FetchProductImages(ctx, ids, IMAGE_FETCH_CONCURRENCY) // Fetch product images by product Id
+
+	// Retry failed fetches with exponential backoff, up to IMAGE_FETCH_ATTEMPTS attempts in total
+	backoff := IMAGE_RETRY_BACKOFF
+	for attempt := 2; attempt <= IMAGE_FETCH_ATTEMPTS && len(errs) > 0 && ctx.Err() == nil; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			continue
+		}
+		backoff *= 2
+
+		retryIds := make([]int, 0, len(errs))
+		for productId := range errs {
+			retryIds = append(retryIds, productId)
+		}
+		metricImageRetries.Add(int64(len(retryIds)))
+		retried, retryErrs := opts.client.FetchProductImages(ctx, retryIds, IMAGE_FETCH_CONCURRENCY)
+		for productId, imgData := range retried {
+			images[productId] = imgData
+		}
+		errs = retryErrs
+	}
+	for productId, err := range errs {
+		log.Printf("Error fetching image for product %d: %v\n", productId, err)
+		res.failedIds = append(res.failedIds, productId)
+	}
+	for productId, imgData := range images {
+		res.images = append(res.images, productImage{product: storedById[productId], data: imgData})
+	}
+	res.fetched, res.failed = len(images), len(errs)
+	return res
+}
+
 // statusWorker process job statuses, received via the job status channel, and handles them accordingly.
 // It prints successful job information and re-queues failed jobs after removing the problematic product.
 // (will handle TCGPlayer API fetch errors in the future)
-func statusWorker(id int, ctx context.Context, jobStatChan <-chan JobStatus,
-	jobChan chan<- Job, imgInfoChan chan<- []datastore.Product, wg *sync.WaitGroup) {
+func statusWorker(id int, ctx context.Context, jobStatChan <-chan JobStatus, retryChan chan<- Job,
+	imgInfoChan chan<- []datastore.Product, wg *sync.WaitGroup, pending *sync.WaitGroup, progress *Progress, lineFormat string,
+	failFast context.CancelCauseFunc) {
 	defer wg.Done()
 	// Process job statuses from the job status channel
 	for {
-		status, open := <-jobStatChan
+		var status JobStatus
+		var open bool
+		select {
+		case status, open = <-jobStatChan:
+		case <-ctx.Done():
+			return // Statuses left in the channel are counted when the pool is drained
+		}
 		if !open {
 			//fmt.Printf("Status Worker %d: No more job statuses to process. Exiting.\n", id)
 			return
 		}
 
 		set := status.job.set
+		// Stop if the scrape was canceled while receiving; failed jobs are not re-queued
+		if ctx.Err() != nil {
+			abandonStatus(progress, pending, status)
+			return
+		}
 		if status.success {
-			fmt.Printf("%-5d %-70s %-5d\n", set.Id, set.Name, set.Count)
-			imgInfoChan <- status.job.productList // Send product list to image data channel for image fetching
+			fmt.Printf(lineFormat, set.Id, set.Name, set.Count)
+			progress.SetCompleted(len(status.job.productList))             // Record completed set for progress reporting
+			metricProductsInserted.Add(int64(len(status.job.productList))) // Record inserted products for metrics
+			metricSetsCompleted.Add(1)
+			select {
+			case imgInfoChan <- status.job.productList: // Send product list to image data channel for image fetching
+				jobFinished(pending)
+			case <-ctx.Done():
+				progress.ImagesNotFetched()
+				jobFinished(pending)
+				return
+			}
 		} else {
 			var pgErr *pgconn.PgError
-			if errors.As(status.err, &pgErr) {
-				switch pgErr.Code {
-				case datastore.UniqueViolationError:
-					duplicateKey := getDuplicateKey(pgErr.Detail)                                               // Extract duplicate key from error detail
-					status.job.productList = removeProductByProductNumber(status.job.productList, duplicateKey) // Remove duplicate product
-					jobChan <- *status.job
-				case datastore.SerializationFailureError:
-					jobChan <- *status.job // Re-queue job for retry
-				default:
-					fmt.Printf("\nUnhandled Postgres error code %s for set %s: %v\n\n", pgErr.Code, status.job.productList[0].SetName, status.err)
-
+			switch {
+			case errors.Is(status.err, datastore.ErrDuplicate) && errors.As(status.err, &pgErr):
+				duplicateKey := getDuplicateKey(pgErr.Detail) // Extract duplicate product number from error detail
+				products, removed := removeProductByProductNumber(status.job.productList, duplicateKey)
+				if removed == 0 {
+					failSet(status.job.set, status.err, progress, failFast) // The duplicate isn't a product of the job, so a retry would fail again
+					jobFinished(pending)
+					break
+				}
+				status.job.productList = products // Remove duplicate product
+				metricProductsDup.Add(int64(removed))
+				if !requeueJob(ctx, retryChan, status, pending, progress) {
+					return
 				}
+			case errors.Is(status.err, datastore.ErrSerializationFailure):
+				if !requeueJob(ctx, retryChan, status, pending, progress) { // Re-queue job for retry
+					return
+				}
+			case errors.As(status.err, &pgErr):
+				fmt.Printf("\nUnhandled Postgres error code %s for set %s: %v\n\n", pgErr.Code, set.Name, status.err)
+				failSet(status.job.set, status.err, progress, failFast)
+				jobFinished(pending)
+			default:
+				failSet(status.job.set, status.err, progress, failFast) // Non-Postgres errors are not retried
+				jobFinished(pending)
+			}
+		}
+
+	}
+}
+
+// failSet records a set that failed with err and won't be retried. If failFast is not nil, the
+// scrape is canceled with the set's error as the cause.
+func failSet(set *datastore.Set, err error, progress *Progress, failFast context.CancelCauseFunc) {
+	progress.SetFailed(set.Name, err)
+	metricSetsFailed.Add(1)
+	if failFast != nil {
+		failFast(fmt.Errorf("Set '%s' failed: %w", set.Name, err))
+	}
+}
+
+// requeueJob sends the job of a failed status to the retry worker, which forwards it to the job
+// workers for another attempt. It returns false, recording the job as not processed, if the
+// scrape is canceled first.
+func requeueJob(ctx context.Context, retryChan chan<- Job, status JobStatus, pending *sync.WaitGroup, progress *Progress) bool {
+	metricJobRetries.Add(1)
+	select {
+	case retryChan <- *status.job:
+		return true
+	case <-ctx.Done():
+		abandonStatus(progress, pending, status)
+		return false
+	}
+}
+
+// retryWorker forwards jobs re-queued by the status workers back to the job workers. Jobs are
+// held in an unbounded queue, so a status worker never blocks on a full jobs channel while the
+// job workers are blocked sending statuses, which would deadlock the pool.
+func retryWorker(ctx context.Context, retryChan <-chan Job, jobsChan chan<- Job, wg *sync.WaitGroup,
+	pending *sync.WaitGroup, progress *Progress) {
+	defer wg.Done()
+
+	var queue []Job
+	for retryChan != nil || len(queue) > 0 {
+		var out chan<- Job // Nil, disabling the send case, while the queue is empty
+		var next Job
+		if len(queue) > 0 {
+			out, next = jobsChan, queue[0]
+		}
+		select {
+		case job, open := <-retryChan:
+			if !open {
+				retryChan = nil // Stop receiving once the retry channel is closed
+				continue
+			}
+			queue = append(queue, job)
+		case out <- next:
+			queue = queue[1:]
+		case <-ctx.Done():
+			for range queue {
+				jobFinished(pending)
+				progress.SetNotProcessed()
 			}
+			return
 		}
+	}
+}
 
+// waitForJobs waits until every pending job has reached a final status or ctx is canceled.
+func waitForJobs(ctx context.Context, pending *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// jobStarted records a job entering the pipeline.
+func jobStarted(pending *sync.WaitGroup) {
+	metricSetsInFlight.Add(1)
+	pending.Add(1)
+}
+
+// jobFinished records a job leaving the pipeline, whether it was written, failed for good, or
+// was dropped after the scrape was canceled.
+func jobFinished(pending *sync.WaitGroup) {
+	metricSetsInFlight.Add(-1)
+	pending.Done()
+}
+
+// abandonStatus records progress for a job status dropped from the pipeline after the scrape
+// is canceled. Sets whose products were written count as completed without images.
+func abandonStatus(progress *Progress, pending *sync.WaitGroup, status JobStatus) {
+	jobFinished(pending)
+	if status.success {
+		progress.SetCompleted(len(status.job.productList))
+		progress.ImagesNotFetched()
+		metricProductsInserted.Add(int64(len(status.job.productList)))
+		metricSetsCompleted.Add(1)
+	} else {
+		progress.SetNotProcessed()
+	}
+}
+
+// drainWorkerPool records progress for the work left in the pool's channels after the workers
+// have exited early because the scrape was canceled. Every channel must already be closed.
+func drainWorkerPool(wpConfig *WorkerPoolConfig) {
+	for range wpConfig.dataCtxChan {
+		wpConfig.progress.SetNotProcessed()
+	}
+	for range wpConfig.jobsChan {
+		jobFinished(wpConfig.pendingJobs)
+		wpConfig.progress.SetNotProcessed()
+	}
+	for range wpConfig.retryChan {
+		jobFinished(wpConfig.pendingJobs)
+		wpConfig.progress.SetNotProcessed()
+	}
+	for status := range wpConfig.jobStatChan {
+		abandonStatus(wpConfig.progress, wpConfig.pendingJobs, status)
+	}
+	for range wpConfig.imgInfoChan {
+		wpConfig.progress.ImagesNotFetched()
 	}
 }
 
@@ -331,103 +1155,351 @@ type JobStatus struct {
 }
 
 // LaunchWorkerPool initializes and starts the worker pool (job workers, status worker, and data workers)
-func LaunchWorkerPool(wpConfig *WorkerPoolConfig) {
+func LaunchWorkerPool(wpConfig *WorkerPoolConfig) *WorkerPool {
 	// Launch job workers
-	for i := 1; i <= wpConfig.poolSize; i++ {
+	for i := 1; i <= wpConfig.jobWorkers; i++ {
 		wpConfig.jobWaitGroup.Add(1)
-		go jobWorker(i, context.Background(), wpConfig.jobsChan, wpConfig.jobStatChan, wpConfig.jobWaitGroup, wpConfig.store)
+		go jobWorker(i, wpConfig.ctx, wpConfig.jobsChan, wpConfig.jobStatChan, wpConfig.jobWaitGroup, wpConfig.pendingJobs, wpConfig.store, wpConfig.progress, wpConfig.upsert,
+			wpConfig.auditLog)
 	}
 
 	// Launch data context workers
-	for j := 1; j <= wpConfig.poolSize; j++ {
+	for j := 1; j <= wpConfig.dataWorkers; j++ {
 		wpConfig.dataWaitGroup.Add(1)
-		go dataWorker(j, wpConfig.ctx, wpConfig.dataCtxChan, wpConfig.jobsChan, wpConfig.dataWaitGroup)
+		go dataWorker(j, wpConfig.ctx, wpConfig.dataCtxChan, wpConfig.jobsChan, wpConfig.dataWaitGroup, wpConfig.pendingJobs, wpConfig.client, wpConfig.progress, wpConfig.exactSetName,
+			wpConfig.failFast)
 	}
 
 	// Launch status worker
 	for k := 1; k <= wpConfig.poolSize; k++ {
 		wpConfig.statusWaitGroup.Add(1)
-		go statusWorker(k, wpConfig.ctx, wpConfig.jobStatChan, wpConfig.jobsChan, wpConfig.imgInfoChan, wpConfig.statusWaitGroup)
+		go statusWorker(k, wpConfig.ctx, wpConfig.jobStatChan, wpConfig.retryChan, wpConfig.imgInfoChan, wpConfig.statusWaitGroup, wpConfig.pendingJobs, wpConfig.progress, wpConfig.setLineFormat,
+			wpConfig.failFast)
 	}
 
+	// Launch retry worker
+	wpConfig.retryWaitGroup.Add(1)
+	go retryWorker(wpConfig.ctx, wpConfig.retryChan, wpConfig.jobsChan, wpConfig.retryWaitGroup, wpConfig.pendingJobs, wpConfig.progress)
+
 	// Launch image worker
-	for l := 1; l <= wpConfig.poolSize+2; l++ {
+	for l := 1; l <= wpConfig.imageWorkers; l++ {
 		wpConfig.imageWaitGroup.Add(1)
-		go imageWorker(l, wpConfig.ctx, wpConfig.imgInfoChan, wpConfig.imageWaitGroup, wpConfig.store)
+		go imageWorker(l, wpConfig.ctx, wpConfig.imgInfoChan, wpConfig.imageWaitGroup, wpConfig.store, wpConfig.progress, wpConfig.imageOpts)
 	}
+
+	return &WorkerPool{wpConfig}
+}
+
+// WorkerPool is a worker pool launched by LaunchWorkerPool. Data contexts are sent to the pool
+// on its data context channel, and Shutdown is called once no more will be sent.
+type WorkerPool struct {
+	*WorkerPoolConfig
+}
+
+// Shutdown closes the pool's channels and waits for its workers in dependency order: each
+// channel is closed only after every worker sending on it has exited. Without cancellation,
+// Shutdown returns once every enqueued set has been processed. Once the pool context is
+// canceled, workers stop on their own and the work left in the channels is counted as not
+// processed. The data context channel must not be sent on after Shutdown is called.
+func (wp *WorkerPool) Shutdown() {
+	close(wp.dataCtxChan)   // Close data context channel to signal data workers no more data contexts will be sent
+	wp.dataWaitGroup.Wait() // Wait for all data workers to finish
+
+	// Status workers re-queue failed jobs, so the job channel can only be closed once every job
+	// has reached a final status. Once canceled, workers stop on their own instead.
+	waitForJobs(wp.ctx, wp.pendingJobs)
+	if wp.ctx.Err() != nil {
+		wp.jobWaitGroup.Wait()
+		wp.retryWaitGroup.Wait()
+		wp.statusWaitGroup.Wait()
+		wp.imageWaitGroup.Wait()
+	}
+
+	close(wp.jobsChan)                   // Close job channel to signal workers no more jobs will be sent
+	wp.jobWaitGroup.Wait()               // Wait for all job workers to finish
+	close(wp.retryChan)                  // Close retry channel to signal retry worker no more jobs will be re-queued
+	wp.retryWaitGroup.Wait()             // Wait for retry worker to finish
+	close(wp.jobStatChan)                // Close error channel to signal error worker no more errors will be sent
+	wp.statusWaitGroup.Wait()            // Wait for status worker to finish
+	close(wp.imgInfoChan)                // Close image info channel to signal image worker no more image requests will be sent
+	wp.imageWaitGroup.Wait()             // Wait for image worker to finish
+	drainWorkerPool(wp.WorkerPoolConfig) // Count work left unprocessed by workers that stopped on cancellation
 }
 
 // WorkerPoolConfig holds configuration for the worker pool
 type WorkerPoolConfig struct {
 	ctx             context.Context
-	poolSize        int
+	poolSize        int                      // Number of status workers, and the base of the other worker counts
+	dataWorkers     int                      // Number of data workers fetching products from the TCGPlayer API
+	jobWorkers      int                      // Number of job workers writing sets to the data store
+	imageWorkers    int                      // Number of image workers fetching and storing product images
 	dataCtxChan     chan DataContext         // Channel for data contexts
 	jobsChan        chan Job                 // Channel for jobs to be processed
 	jobStatChan     chan JobStatus           // Channel for job statuses
+	retryChan       chan Job                 // Channel for failed jobs re-queued by the status workers
 	imgInfoChan     chan []datastore.Product // Channel for image data requests
 	store           UserDataStore
+	client          ProductFetcher          // Source of products, the TCGPlayer API client outside of tests
+	progress        *Progress               // Shared progress counters
+	setLineFormat   string                  // Format used by the status worker to print completed sets
+	exactSetName    bool                    // Drop fetched products whose set url name doesn't match the requested set
+	upsert          bool                    // Update sets and products already stored instead of failing the job
+	failFast        context.CancelCauseFunc // Cancels the scrape when a set fails, nil to continue past failed sets
+	auditLog        *auditLog               // Records the products written for each set, nil if disabled
+	imageOpts       ImageOptions
 	dataWaitGroup   *sync.WaitGroup
 	jobWaitGroup    *sync.WaitGroup
 	statusWaitGroup *sync.WaitGroup
 	imageWaitGroup  *sync.WaitGroup
+	retryWaitGroup  *sync.WaitGroup
+	pendingJobs     *sync.WaitGroup // Jobs sent by the data workers that haven't reached a final status
 }
 
 func NewWorkerPoolConfig(ctx context.Context, poolSize int, dataCtxChan chan DataContext, jobChan chan Job,
-	jobStatusChan chan JobStatus, imgInfoChan chan []datastore.Product, store UserDataStore) *WorkerPoolConfig {
+	jobStatusChan chan JobStatus, imgInfoChan chan []datastore.Product, store UserDataStore, progress *Progress) *WorkerPoolConfig {
 	return &WorkerPoolConfig{
 		ctx:             ctx,
 		poolSize:        poolSize,
+		dataWorkers:     poolSize,
+		jobWorkers:      poolSize,
+		imageWorkers:    poolSize + 2,
 		dataCtxChan:     dataCtxChan,
 		jobsChan:        jobChan,
 		jobStatChan:     jobStatusChan,
+		retryChan:       make(chan Job, poolSize),
 		imgInfoChan:     imgInfoChan,
 		store:           store,
+		progress:        progress,
+		setLineFormat:   "%-5d %-70s %-5d\n",
 		dataWaitGroup:   &sync.WaitGroup{},
 		jobWaitGroup:    &sync.WaitGroup{},
 		statusWaitGroup: &sync.WaitGroup{},
 		imageWaitGroup:  &sync.WaitGroup{},
+		retryWaitGroup:  &sync.WaitGroup{},
+		pendingJobs:     &sync.WaitGroup{},
 	}
 }
 
+// duplicateKeyRegexp matches the detail of a Postgres unique violation, such as
+// "Key (product_number, rarity_name, set_id)=(001, Common, 5) already exists.", capturing the
+// key columns and values.
+var duplicateKeyRegexp = regexp.MustCompile(`^Key \((.*?)\)=\((.*)\) already exists`)
+
+// getDuplicateKey returns the product number of the duplicate key in the detail of a Postgres
+// unique violation, or an empty string if the violated key doesn't start with product_number.
+// The number is everything before the values of the remaining key columns, so numbers holding
+// commas are returned whole.
 func getDuplicateKey(errDetail string) string {
-	rgx := regexp.MustCompile(`\((.*?)\)`)
-	rs := rgx.FindStringSubmatch(errDetail)
-	var number string
-	if len(rs) > 1 {
-		number = strings.Split(rs[3], ",")[0]
+	rs := duplicateKeyRegexp.FindStringSubmatch(errDetail)
+	if rs == nil {
+		return ""
+	}
+	columns := strings.Split(rs[1], ", ")
+	values := strings.Split(rs[2], ", ")
+	if columns[0] != "product_number" || len(values) < len(columns) {
+		return ""
 	}
-	return number
+	return strings.Join(values[:len(values)-len(columns)+1], ", ")
 }
 
-// getSetsNotInDatastore compares sets fetched from the TCGPlayer API with sets in the user data store for a given
-// product line and returns a list of sets that are present in the TCGPlayer API but not in the user data store.
-func getSetsNotInDatastore(pl *datastore.Product_Line, store UserDataStore) ([]datastore.Set, error) {
-	tcapiSets := tcapi.FetchSetsByProductLine(pl.UrlName) // Fetch sets for the product line
-	setMap := make(map[string]datastore.Set)
+// auditAttributes scans every stored product and prints those whose custom attributes fail
+// validation. It returns the number of products scanned and the number that failed.
+func auditAttributes(ctx context.Context, store UserDataStore) (scanned int, failed int, err error) {
+	err = store.EachProduct(ctx, func(p datastore.Product) error {
+		scanned++
+		if vErr := tcapi.ValidateCustomAttributes(p.ProductLineUrlName, p.CustomAttributes); vErr != nil {
+			failed++
+			fmt.Printf("%-8d %-30s %-60s %v\n", p.ProductId, p.SetUrlName, p.ProductName, vErr)
+		}
+		return nil
+	})
+	return scanned, failed, err
+}
 
-	// Populate map with sets from the TCGPlayer API, using UrlName as the key for easy lookup
-	for _, val := range tcapiSets {
-		setMap[val.UrlName] = val
+// refreshSetCounts updates the stored card count of each stored set of the product line whose
+// count in the TCGPlayer set aggregation differs, printing each changed set with its old and
+// new counts. Products are not fetched. It returns the number of sets updated.
+func refreshSetCounts(ctx context.Context, client *tcapi.Client, store UserDataStore, pl *datastore.Product_Line, productType string) (int, error) {
+	storedPl, err := store.GetProductLineByName(ctx, pl.UrlName)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return 0, nil // Nothing is stored for the product line
 	}
+	if err != nil {
+		return 0, fmt.Errorf("Error fetching product line '%s': %w", pl.UrlName, err)
+	}
+	storedSets, err := store.GetSetsByProductLineId(ctx, storedPl.Id)
+	if err != nil {
+		return 0, fmt.Errorf("Error fetching sets from database: %w", err)
+	}
+
+	counts := make(map[string]int) // Current set counts keyed by set url name
+	for _, set := range client.FetchSetsByProductLine(pl.UrlName, productType) {
+		counts[set.UrlName] = set.Count
+	}
+
+	var updated int
+	for _, set := range storedSets {
+		count, ok := counts[set.UrlName]
+		if !ok {
+			continue
+		}
+		refreshed := set
+		refreshed.Count = count
+		if refreshed.Equal(set) {
+			continue // Skip no-op updates
+		}
+		if err := store.UpdateSetCount(ctx, set.Id, count); err != nil {
+			return updated, err
+		}
+		updated++
+		fmt.Printf("%-60s %6d -> %-6d (%+d)\n", set.Name, set.Count, count, count-set.Count)
+	}
+	return updated, nil
+}
+
+// printSetCounts fetches and prints the number of products of the specified product type in
+// each set, followed by the total, without fetching any products.
+func printSetCounts(ctx context.Context, client *tcapi.Client, pl *datastore.Product_Line, productType string) {
+	sets := client.FetchSetsByProductLine(pl.UrlName, productType)
+	format := setLineFormat(sets)
+	var total int
+	for i, set := range sets {
+		count, err := client.FetchProductCount(ctx, tcapi.NewSearchParams(pl.UrlName, set.UrlName, productType, 0, 0))
+		if err != nil {
+			log.Printf("Error fetching product count for set '%s': %v", set.Name, err)
+			continue
+		}
+		fmt.Printf(format, i, set.Name, count)
+		total += count
+	}
+	fmt.Printf("%d products in %d sets for product line '%s'\n", total, len(sets), pl.Name)
+}
+
+// preflightCheck verifies the user data store and the TCGPlayer API are reachable, each within
+// PREFLIGHT_TIMEOUT, so a scrape fails fast instead of partway through.
+func preflightCheck(ctx context.Context, client *tcapi.Client, store UserDataStore) error {
+	dbCtx, cancel := context.WithTimeout(ctx, PREFLIGHT_TIMEOUT)
+	defer cancel()
+	if err := store.Ping(dbCtx); err != nil {
+		return fmt.Errorf("Error connecting to database: %w", err)
+	}
+
+	apiCtx, cancel := context.WithTimeout(ctx, PREFLIGHT_TIMEOUT)
+	defer cancel()
+	if err := client.Ping(apiCtx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkDatabase opens a connection pool with config and runs a minimal query, returning the
+// first failure. Connecting and querying must finish within PREFLIGHT_TIMEOUT.
+func checkDatabase(ctx context.Context, config *pgxpool.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, PREFLIGHT_TIMEOUT)
+	defer cancel()
+
+	pool, err := datastore.NewDBPool(ctx, config)
+	if err != nil {
+		return fmt.Errorf("Error creating DB connection pool: %w", err)
+	}
+	defer pool.Close()
+
+	var one int
+	if err := pool.QueryRow(ctx, "SELECT 1;").Scan(&one); err != nil {
+		return fmt.Errorf("Error running test query: %w", err)
+	}
+	return nil
+}
+
+// setAlreadyScraped reports whether the set is stored in the user data store with at least
+// its expected number of products. It also returns the stored set and its number of stored
+// products, which are zero if the set isn't stored.
+func setAlreadyScraped(ctx context.Context, store UserDataStore, set datastore.Set) (bool, datastore.Set, int, error) {
+	stored, productCount, err := store.GetSetByUrlName(ctx, set.UrlName)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return false, datastore.Set{}, 0, nil
+	}
+	if err != nil {
+		return false, datastore.Set{}, 0, err
+	}
+	return productCount >= set.Count, stored, productCount, nil
+}
+
+// parseHeaders parses headers given as "Name: value" into an http.Header.
+func parseHeaders(headers []string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header '%s', expected 'Name: value'", h)
+		}
+		parsed.Add(name, strings.TrimSpace(value))
+	}
+	return parsed, nil
+}
+
+// filterSetsReleasedAfter returns the sets released after since, each with its release date set
+// from the earliest released product fetched from the TCGPlayer API. Sets whose release date
+// can't be determined are kept, so an incremental scrape never misses them. An error is
+// returned if no set of the product line has a release date.
+func filterSetsReleasedAfter(client *tcapi.Client, pl *datastore.Product_Line, sets []datastore.Set, productType string,
+	since time.Time) ([]datastore.Set, error) {
+	var filtered []datastore.Set
+	var dated int
+	for _, set := range sets {
+		releasedOn, ok := client.FetchSetReleaseDate(pl.UrlName, set.UrlName, productType)
+		if !ok {
+			log.Printf("Release date of set '%s' is unknown, keeping it", set.Name)
+			filtered = append(filtered, set)
+			continue
+		}
+		dated++
+		if releasedOn.After(since) {
+			set.ReleasedOn = releasedOn
+			filtered = append(filtered, set)
+		}
+	}
+	if dated == 0 && len(sets) > 0 {
+		return nil, fmt.Errorf("Release dates aren't available for the sets of product line '%s', --since can't be used", pl.Name)
+	}
+	return filtered, nil
+}
+
+// filterSetsByUrlName returns the sets whose UrlName is urlName.
+func filterSetsByUrlName(sets []datastore.Set, urlName string) []datastore.Set {
+	var filtered []datastore.Set
+	for _, set := range sets {
+		if set.UrlName == urlName {
+			filtered = append(filtered, set)
+		}
+	}
+	return filtered
+}
+
+// getSetsNotInDatastore compares sets fetched from the TCGPlayer API with sets in the user data store for a given
+// product line and returns a list of sets that are present in the TCGPlayer API but not in the user data store,
+// in the order returned by the TCGPlayer API, so --limit always takes the same sets.
+// Set counts only include products of the specified product type.
+func getSetsNotInDatastore(client *tcapi.Client, pl *datastore.Product_Line, productType string, store UserDataStore) ([]datastore.Set, error) {
+	tcapiSets := client.FetchSetsByProductLine(pl.UrlName, productType)      // Fetch sets for the product line
 	dbSets, err := store.GetSetsByProductLineId(context.Background(), pl.Id) // Fetch sets for the product line from the database
 	if err != nil {
 		return nil, fmt.Errorf("Error fetching sets from database: %w", err)
 	}
 
-	// Loop through sets from the database and remove any matching sets from the map of sets from the TCGPlayer API
+	// Populate map with sets from the database, using UrlName as the key for easy lookup
+	stored := make(map[string]bool)
 	for _, elem := range dbSets {
-		_, exists := setMap[elem.UrlName]
-		if exists {
-			delete(setMap, elem.UrlName)
-		}
+		stored[elem.UrlName] = true
 	}
 
-	sets := make([]datastore.Set, len(setMap)) // Create slice to hold sets that are in the TCGPlayer API but not in the database
-	i := 0
-	for _, val := range setMap {
-		sets[i] = val
-		i++
+	// Filter the sets from the TCGPlayer API, rather than ranging over a map, to keep their order
+	var sets []datastore.Set // Sets that are in the TCGPlayer API but not in the database
+	for _, val := range tcapiSets {
+		if !stored[val.UrlName] {
+			sets = append(sets, val)
+		}
 	}
-
 	return sets, nil
 }
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gurbos/tcd/datastore"
+	"github.com/gurbos/tcd/tcapi"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestGetDuplicateKey(t *testing.T) {
+	tests := []struct {
+		detail string
+		want   string
+	}{
+		{"Key (product_number, rarity_name, set_id)=(001, Common, 5) already exists.", "001"},
+		{"Key (product_number, rarity_name, set_id)=(LOB-EN001, Ultra Rare, 12) already exists.", "LOB-EN001"},
+		{"Key (product_number, rarity_name, set_id)=(1, 2, Common, 5) already exists.", "1, 2"}, // Number holding a comma
+		{"Key (set_url_name)=(legend-of-blue-eyes) already exists.", ""},                        // Not a product key
+		{"Key (product_id)=(12345) already exists.", ""},
+		{"not a unique violation detail", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := getDuplicateKey(tt.detail); got != tt.want {
+			t.Errorf("getDuplicateKey(%q) = %q, want %q", tt.detail, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveProductByProductNumber(t *testing.T) {
+	products := []datastore.Product{{ProductNumber: "001"}, {ProductNumber: "002"}, {ProductNumber: "003"}}
+	tests := []struct {
+		number      string
+		wantNumbers []string
+		wantRemoved int
+	}{
+		{"002", []string{"001", "003"}, 1},
+		{"004", []string{"001", "002", "003"}, 0},
+		{"", []string{"001", "002", "003"}, 0},
+	}
+	for _, tt := range tests {
+		got, removed := removeProductByProductNumber(products, tt.number)
+		var numbers []string
+		for _, p := range got {
+			numbers = append(numbers, p.ProductNumber)
+		}
+		if !slices.Equal(numbers, tt.wantNumbers) || removed != tt.wantRemoved {
+			t.Errorf("removeProductByProductNumber(%q) = %v, %d, want %v, %d", tt.number, numbers, removed, tt.wantNumbers, tt.wantRemoved)
+		}
+	}
+}
+
+// duplicateStatus returns the status of a failed job whose write hit a Postgres unique violation
+// with the specified detail.
+func duplicateStatus(detail string) JobStatus {
+	set := datastore.Set{Name: "Legend of Blue Eyes", UrlName: "legend-of-blue-eyes"}
+	products := []datastore.Product{{ProductNumber: "LOB-001"}, {ProductNumber: "LOB-002"}}
+	err := &datastore.Error{
+		Kind: datastore.ErrDuplicate,
+		Err:  &pgconn.PgError{Code: datastore.UniqueViolationError, Detail: detail},
+	}
+	return JobStatus{job: &Job{set: &set, productList: products}, err: err}
+}
+
+// runStatusWorker sends status to a status worker and returns the job it re-queued, if any, along
+// with the progress counters.
+func runStatusWorker(t *testing.T, status JobStatus) (*Job, *Progress) {
+	t.Helper()
+	statChan := make(chan JobStatus, 1)
+	retryChan := make(chan Job, 1)
+	imgChan := make(chan []datastore.Product, 1)
+	var wg, pending sync.WaitGroup
+	progress := NewProgress(1)
+
+	jobStarted(&pending)
+	wg.Add(1)
+	go statusWorker(1, context.Background(), statChan, retryChan, imgChan, &wg, &pending, progress, "%d %s %d\n", nil)
+	statChan <- status
+	close(statChan)
+	wg.Wait()
+
+	select {
+	case job := <-retryChan:
+		jobFinished(&pending)
+		return &job, progress
+	default: // The worker has exited, so a re-queued job is already buffered
+		return nil, progress
+	}
+}
+
+func TestStatusWorkerRemovesDuplicateProduct(t *testing.T) {
+	job, progress := runStatusWorker(t, duplicateStatus(
+		"Key (product_number, rarity_name, set_id)=(LOB-002, Common, 5) already exists."))
+	if job == nil {
+		t.Fatal("job with a duplicate product was not re-queued")
+	}
+	if len(job.productList) != 1 || job.productList[0].ProductNumber != "LOB-001" {
+		t.Errorf("re-queued products = %v, want only LOB-001", job.productList)
+	}
+	if failed := progress.FailedSets(); len(failed) != 0 {
+		t.Errorf("failed sets = %v, want none", failed)
+	}
+}
+
+func TestStatusWorkerFailsSetOnOtherDuplicate(t *testing.T) {
+	status := duplicateStatus("Key (set_url_name)=(legend-of-blue-eyes) already exists.")
+	job, progress := runStatusWorker(t, status)
+	if job != nil {
+		t.Fatal("job whose duplicate isn't one of its products was re-queued")
+	}
+	failed := progress.FailedSets()
+	if len(failed) != 1 || !errors.Is(status.err, datastore.ErrDuplicate) {
+		t.Errorf("failed sets = %v, want the set recorded as failed", failed)
+	}
+}
+
+// stubFetcher is a ProductFetcher serving fixed products per set url name, and an image for
+// every product id.
+type stubFetcher struct {
+	products map[string][]datastore.Product // Products of each set, keyed by set url name
+	errs     map[string]error               // Errors fetching the products of sets, keyed by set url name
+}
+
+func (f *stubFetcher) FetchProductsInParts(ctx context.Context, sParams tcapi.SearchParams) ([]datastore.Product, tcapi.FetchStats) {
+	products := slices.Clone(f.products[sParams.SetName])
+	return products, tcapi.FetchStats{Calls: 1, ExpectedCalls: 1, Err: f.errs[sParams.SetName]}
+}
+
+func (f *stubFetcher) FetchProductImageById(ctx context.Context, imageId int) ([]byte, error) {
+	return []byte{byte(imageId)}, nil
+}
+
+func (f *stubFetcher) FetchProductImages(ctx context.Context, ids []int, concurrency int) (map[int][]byte, map[int]error) {
+	images := make(map[int][]byte, len(ids))
+	for _, id := range ids {
+		images[id] = []byte{byte(id)}
+	}
+	return images, nil
+}
+
+// runWorkerPool sends a data context for each set to a worker pool writing to store, shuts the
+// pool down, and returns its progress. failFast is set on the pool when not nil.
+func runWorkerPool(ctx context.Context, store *datastore.InMemoryDataStore, fetcher *stubFetcher, sets []datastore.Set,
+	failFast context.CancelCauseFunc) *Progress {
+	progress := NewProgress(len(sets))
+	wpConfig := NewWorkerPoolConfig(ctx, 2, make(chan DataContext, len(sets)), make(chan Job, 2),
+		make(chan JobStatus, 2), make(chan []datastore.Product, 2), store, progress)
+	wpConfig.client = fetcher
+	wpConfig.failFast = failFast
+	wpConfig.imageOpts = ImageOptions{client: fetcher, store: IMAGE_STORE_DB}
+	pool := LaunchWorkerPool(wpConfig)
+
+	productLine := datastore.Product_Line{Id: 1, Name: "YuGiOh", UrlName: "yugioh"}
+	for _, set := range sets {
+		sParams := tcapi.NewSearchParams(productLine.UrlName, set.UrlName, "", 0, set.Count)
+		wpConfig.dataCtxChan <- DataContext{productLine: productLine, set: set, searchParams: sParams}
+	}
+	pool.Shutdown()
+	return progress
+}
+
+func TestWorkerPool(t *testing.T) {
+	fetcher := &stubFetcher{products: map[string][]datastore.Product{
+		"metal-raiders": {
+			{ProductId: 101, ProductName: "Feral Imp", ProductNumber: "MRD-001", RarityName: "Common", SetName: "Metal Raiders"},
+			{ProductId: 102, ProductName: "Winged Dragon", ProductNumber: "MRD-002", RarityName: "Common", SetName: "Metal Raiders"},
+			{ProductId: 102, ProductName: "Winged Dragon", ProductNumber: "MRD-002", RarityName: "Common", SetName: "Metal Raiders"}, // Duplicate
+		},
+		"spell-ruler": {
+			{ProductId: 201, ProductName: "Ancient Brain", ProductNumber: "SRL-001", RarityName: "Common", SetName: "Spell Ruler"},
+			{ProductId: 202, ProductName: "No Number", RarityName: "Common", SetName: "Spell Ruler"}, // Dropped without a number
+		},
+	}}
+	sets := []datastore.Set{
+		{Name: "Metal Raiders", UrlName: "metal-raiders", Count: 3},
+		{Name: "Spell Ruler", UrlName: "spell-ruler", Count: 2},
+		{Name: "Pharaoh's Servant", UrlName: "pharaohs-servant", Count: 1}, // No products fetched
+	}
+
+	store := datastore.NewInMemoryDataStore()
+	progress := runWorkerPool(context.Background(), store, fetcher, sets, nil)
+
+	ctx := context.Background()
+	tests := []struct {
+		set      string
+		products int
+	}{
+		{"metal-raiders", 2},
+		{"spell-ruler", 1},
+	}
+	for _, tt := range tests {
+		set, count, err := store.GetSetByUrlName(ctx, tt.set)
+		if err != nil || count != tt.products || set.Count != tt.products {
+			t.Errorf("set %s: %+v with %d products stored, %v, want %d products", tt.set, set, count, err, tt.products)
+			continue
+		}
+		products, _ := store.GetProductsBySetIds(ctx, []int{set.Id})
+		for _, p := range products {
+			if _, err := store.GetProductImage(ctx, p.ProductId); err != nil {
+				t.Errorf("set %s: image of product '%s' not stored: %v", tt.set, p.ProductNumber, err)
+			}
+		}
+	}
+	if _, _, err := store.GetSetByUrlName(ctx, "pharaohs-servant"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("set without products stored, error = %v", err)
+	}
+	if completed, empty := progress.setsCompleted.Load(), progress.setsEmpty.Load(); completed != 3 || empty != 1 {
+		t.Errorf("%d sets completed, %d empty, want 3 completed, the set without products empty", completed, empty)
+	}
+	if summary := progress.Summary(); !strings.Contains(summary, "3/3 sets") || !strings.Contains(summary, "1 sets empty") {
+		t.Errorf("Summary() = %q, want 3/3 sets with 1 empty", summary)
+	}
+	if failed := progress.FailedSets(); len(failed) != 0 {
+		t.Errorf("failed sets = %v, want none", failed)
+	}
+}
+
+func TestWorkerPoolCanceled(t *testing.T) {
+	fetcher := &stubFetcher{products: map[string][]datastore.Product{
+		"metal-raiders": {{ProductId: 101, ProductNumber: "MRD-001", RarityName: "Common", SetName: "Metal Raiders"}},
+	}}
+	sets := []datastore.Set{{Name: "Metal Raiders", UrlName: "metal-raiders", Count: 1}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	progress := runWorkerPool(ctx, datastore.NewInMemoryDataStore(), fetcher, sets, nil)
+	if got := progress.setsCompleted.Load() + progress.setsNotProcessed.Load(); got != 1 {
+		t.Errorf("%d sets completed or counted as not processed, want 1", got)
+	}
+}
+
+func TestPrintListsAlignment(t *testing.T) {
+	list := []tcapi.ValueType{
+		{Name: "Pokémon Japan", UrlName: "pokemon-japan"}, // Multi-byte name
+		{Name: "A", UrlName: "a"},
+		{Name: strings.Repeat("Pokémon ", 12), UrlName: "long"}, // Longest name, in runes and bytes
+	}
+	for i := range 1000 {
+		list = append(list, tcapi.ValueType{Name: fmt.Sprintf("Line %d", i)})
+	}
+
+	var buf bytes.Buffer
+	printLists(&buf, list, "")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != (len(list)+1)/2 {
+		t.Fatalf("printLists() wrote %d lines, want %d", len(lines), (len(list)+1)/2)
+	}
+	// The second column starts after both indexes, the longest name, and the separators
+	col := 2*digits(len(list)-1) + utf8.RuneCountInString(list[2].String()) + 10
+	for i, line := range lines {
+		j := strings.LastIndex(line, " : ")
+		if j < 0 {
+			t.Fatalf("line %d has no second column: %q", i, line)
+		}
+		if j = utf8.RuneCountInString(line[:j]); j != col {
+			t.Errorf("line %d has its second column at %d, want %d: %q", i, j, col, line)
+		}
+	}
+}
+
+func TestSetLineFormat(t *testing.T) {
+	sets := []datastore.Set{
+		{Id: 7, Name: "Pokémon Card 151", Count: 5},
+		{Id: 1234567, Name: "A", Count: 1234567890},
+		{Id: 0, Name: "Not Stored Yet", Count: 12},
+	}
+	format := setLineFormat(sets)
+	var widths []int
+	for _, set := range sets {
+		line := fmt.Sprintf(format, set.Id, set.Name, set.Count)
+		widths = append(widths, utf8.RuneCountInString(line))
+		if !strings.HasSuffix(line, strconv.Itoa(set.Count)+"\n") {
+			t.Errorf("line %q doesn't end with the count %d", line, set.Count)
+		}
+	}
+	if slices.Min(widths) != slices.Max(widths) {
+		t.Errorf("format %q gives lines of widths %v, want equal widths", format, widths)
+	}
+}
+
+func TestDrainWorkerPool(t *testing.T) {
+	set := datastore.Set{Name: "Metal Raiders", UrlName: "metal-raiders"}
+	job := Job{set: &set, productList: []datastore.Product{{ProductNumber: "MRD-001"}, {ProductNumber: "MRD-002"}}}
+	tests := []struct {
+		name                     string
+		dataCtxs, jobs, retries  int
+		succeeded, failed        int // Job statuses left in the status channel
+		imageRequests            int
+		completed, notProcessed  int64
+		productsInserted, images int64
+	}{
+		{"nothing buffered", 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{"data contexts", 3, 0, 0, 0, 0, 0, 0, 3, 0, 0},
+		{"jobs and retries", 0, 2, 1, 0, 0, 0, 0, 3, 0, 0},
+		{"statuses", 0, 0, 0, 2, 1, 0, 2, 1, 4, 2},
+		{"images", 0, 0, 0, 0, 0, 2, 0, 0, 0, 2},
+		{"everything", 1, 1, 1, 1, 1, 1, 1, 4, 2, 2},
+	}
+	for _, tt := range tests {
+		progress := NewProgress(10)
+		wpConfig := NewWorkerPoolConfig(context.Background(), 1, make(chan DataContext, tt.dataCtxs), make(chan Job, tt.jobs),
+			make(chan JobStatus, tt.succeeded+tt.failed), make(chan []datastore.Product, tt.imageRequests), nil, progress)
+		wpConfig.retryChan = make(chan Job, tt.retries)
+
+		for range tt.dataCtxs {
+			wpConfig.dataCtxChan <- DataContext{set: set}
+		}
+		for range tt.jobs {
+			jobStarted(wpConfig.pendingJobs)
+			wpConfig.jobsChan <- job
+		}
+		for range tt.retries {
+			jobStarted(wpConfig.pendingJobs)
+			wpConfig.retryChan <- job
+		}
+		for i := range tt.succeeded + tt.failed {
+			jobStarted(wpConfig.pendingJobs)
+			wpConfig.jobStatChan <- JobStatus{success: i < tt.succeeded, job: &job}
+		}
+		for range tt.imageRequests {
+			wpConfig.imgInfoChan <- job.productList
+		}
+		close(wpConfig.dataCtxChan)
+		close(wpConfig.jobsChan)
+		close(wpConfig.retryChan)
+		close(wpConfig.jobStatChan)
+		close(wpConfig.imgInfoChan)
+
+		drainWorkerPool(wpConfig)
+		wpConfig.pendingJobs.Wait() // Every drained job must have been finished, or this blocks
+
+		got := []int64{progress.setsCompleted.Load(), progress.setsNotProcessed.Load(),
+			progress.productsInserted.Load(), progress.imagesNotFetched.Load()}
+		want := []int64{tt.completed, tt.notProcessed, tt.productsInserted, tt.images}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: completed, not processed, products inserted, images not fetched = %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestFilterProductsBySetUrlName(t *testing.T) {
+	products := []datastore.Product{
+		{ProductNumber: "LOB-001", SetUrlName: "legend-of-blue-eyes-white-dragon"},
+		{ProductNumber: "LOB-EN001", SetUrlName: "Legend-Of-Blue-Eyes-White-Dragon"},       // Case differs
+		{ProductNumber: "LOB-P001", SetUrlName: "legend-of-blue-eyes-white-dragon-promos"}, // Fuzzy match
+		{ProductNumber: "SDK-001", SetUrlName: "starter-deck-kaiba"},
+		{ProductNumber: "LOB-002"}, // No set url name
+	}
+	tests := []struct {
+		set         string
+		wantNumbers []string
+		wantDropped int
+	}{
+		{"legend-of-blue-eyes-white-dragon", []string{"LOB-001", "LOB-EN001"}, 3},
+		{"legend-of-blue-eyes-white-dragon-promos", []string{"LOB-P001"}, 4},
+		{"metal-raiders", nil, 5},
+	}
+	for _, tt := range tests {
+		got, dropped := filterProductsBySetUrlName(products, tt.set)
+		var numbers []string
+		for _, p := range got {
+			numbers = append(numbers, p.ProductNumber)
+		}
+		if !slices.Equal(numbers, tt.wantNumbers) || dropped != tt.wantDropped {
+			t.Errorf("filterProductsBySetUrlName(%q) = %v, %d dropped, want %v, %d dropped", tt.set, numbers, dropped, tt.wantNumbers, tt.wantDropped)
+		}
+	}
+}
+
+func TestRemoveDuplicateProducts(t *testing.T) {
+	tests := []struct {
+		name     string
+		products []datastore.Product
+		want     []string // Set id and number of the products kept, in order
+	}{
+		{"two sets sharing a number", []datastore.Product{
+			{SetId: 1, ProductNumber: "001"},
+			{SetId: 2, ProductNumber: "001"},
+		}, []string{"1/001", "2/001"}},
+		{"duplicate within a set", []datastore.Product{
+			{SetId: 1, ProductNumber: "001", ProductName: "First"},
+			{SetId: 2, ProductNumber: "001"},
+			{SetId: 1, ProductNumber: "001", ProductName: "Second"},
+			{SetId: 1, ProductNumber: "002"},
+		}, []string{"1/001 First", "2/001", "1/002"}},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, p := range removeDuplicateProducts(tt.products) {
+			got = append(got, strings.TrimSpace(fmt.Sprintf("%d/%s %s", p.SetId, p.ProductNumber, p.ProductName)))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: removeDuplicateProducts() kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConnectString(t *testing.T) {
+	tests := []struct {
+		name string
+		cred DBCredentials
+	}{
+		{"plain", DBCredentials{username: "tcd", password: "secret", host: "localhost", port: "5432", dbName: "trading_card_data"}},
+		{"special characters", DBCredentials{username: "tcd@admin", password: "p@ss:w/rd?#%&= ", host: "db.example.com",
+			port: "5433", dbName: "cards"}},
+		{"ipv6 host", DBCredentials{username: "tcd", password: "secret", host: "::1", port: "5432", dbName: "cards"}},
+		{"optional parameters", DBCredentials{username: "tcd", password: "secret", host: "localhost", port: "5432",
+			dbName: "cards", sslMode: "require", connectTimeout: "10", applicationName: "tcd scraper"}},
+	}
+	for _, tt := range tests {
+		config, err := pgxpool.ParseConfig(tt.cred.ConnectString())
+		if err != nil {
+			t.Errorf("%s: ParseConfig(ConnectString()) error: %v", tt.name, err)
+			continue
+		}
+		cc := config.ConnConfig
+		port := strconv.Itoa(int(cc.Port))
+		if cc.User != tt.cred.username || cc.Password != tt.cred.password || cc.Host != tt.cred.host ||
+			port != tt.cred.port || cc.Database != tt.cred.dbName {
+			t.Errorf("%s: parsed %s:%s@%s:%s/%s, want %s:%s@%s:%s/%s", tt.name, cc.User, cc.Password, cc.Host, port, cc.Database,
+				tt.cred.username, tt.cred.password, tt.cred.host, tt.cred.port, tt.cred.dbName)
+		}
+		if tt.cred.connectTimeout != "" && cc.ConnectTimeout != 10*time.Second {
+			t.Errorf("%s: connect timeout %v, want 10s", tt.name, cc.ConnectTimeout)
+		}
+		if got := cc.RuntimeParams["application_name"]; got != tt.cred.applicationName {
+			t.Errorf("%s: application name %q, want %q", tt.name, got, tt.cred.applicationName)
+		}
+	}
+}
+
+func TestImageFileNameMaliciousNumber(t *testing.T) {
+	dir := filepath.Join("images", "yugioh")
+	opts := ImageOptions{dir: dir, path: "{set}/{number}_{rarity}_{suffix}", spec: tcapi.DefaultImageSpec}
+	tests := []string{
+		"../../../etc/passwd",
+		"/etc/passwd",
+		`..\..\windows\system32`,
+		"..",
+		"LOB\x00001",
+		"4/102",
+	}
+	for _, number := range tests {
+		p := datastore.Product{ProductId: 1, SetUrlName: "metal-raiders", ProductNumber: number, RarityName: "Common"}
+		name := imageFileName(p, opts)
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || !filepath.IsLocal(rel) || strings.ContainsAny(name, "\x00\\") {
+			t.Errorf("imageFileName() for number %q = %q, outside the image directory", number, name)
+		}
+		if elems := strings.Split(filepath.ToSlash(rel), "/"); len(elems) != 2 || elems[0] != "metal-raiders" {
+			t.Errorf("imageFileName() for number %q = %q, want a file in the set directory", number, name)
+		}
+	}
+}
+
+func TestWorkerPoolFetchError(t *testing.T) {
+	fetchErr := fmt.Errorf("Error fetching page at offset 50 of set 'metal-raiders': %w", tcapi.ErrSchemaChange)
+	fetcher := &stubFetcher{
+		products: map[string][]datastore.Product{
+			"metal-raiders": {{ProductId: 101, ProductNumber: "MRD-001", RarityName: "Common", SetName: "Metal Raiders"}},
+			"spell-ruler":   {{ProductId: 201, ProductNumber: "SRL-001", RarityName: "Common", SetName: "Spell Ruler"}},
+		},
+		errs: map[string]error{"metal-raiders": fetchErr},
+	}
+	sets := []datastore.Set{
+		{Name: "Metal Raiders", UrlName: "metal-raiders", Count: 51},
+		{Name: "Spell Ruler", UrlName: "spell-ruler", Count: 1},
+	}
+
+	for _, failFast := range []bool{false, true} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		var cancelCause context.CancelCauseFunc
+		if failFast {
+			cancelCause = cancel
+		}
+		store := datastore.NewInMemoryDataStore()
+		progress := runWorkerPool(ctx, store, fetcher, sets[:1], cancelCause)
+
+		failed := progress.FailedSets()
+		if len(failed) != 1 || !strings.HasPrefix(failed[0], "Metal Raiders: ") {
+			t.Errorf("fail fast %t: failed sets = %v, want Metal Raiders", failFast, failed)
+		}
+		if _, _, err := store.GetSetByUrlName(context.Background(), "metal-raiders"); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("fail fast %t: partially fetched set stored, error = %v", failFast, err)
+		}
+		if failFast != errors.Is(context.Cause(ctx), tcapi.ErrSchemaChange) {
+			t.Errorf("fail fast %t: scrape canceled with cause %v", failFast, context.Cause(ctx))
+		}
+		cancel(nil)
+	}
+
+	// Other sets are still stored without fail fast
+	store := datastore.NewInMemoryDataStore()
+	progress := runWorkerPool(context.Background(), store, fetcher, sets, nil)
+	if _, count, err := store.GetSetByUrlName(context.Background(), "spell-ruler"); err != nil || count != 1 {
+		t.Errorf("set after a failed set: %d products stored, %v, want 1", count, err)
+	}
+	if len(progress.FailedSets()) != 1 {
+		t.Errorf("failed sets = %v, want only Metal Raiders", progress.FailedSets())
+	}
+}
+
+func TestAuditAttributesMalformed(t *testing.T) {
+	ctx := context.Background()
+	store := datastore.NewInMemoryDataStore()
+	set := datastore.Set{Name: "Metal Raiders", UrlName: "metal-raiders"}
+	var products []datastore.Product
+	for i, attrs := range []string{
+		`{"number": "MRD-001", "releaseDate": "2002-06-26T00:00:00Z"}`, // Valid
+		`["MRD-002"]`,                   // Not an object
+		`"MRD-003"`,                     // Not an object
+		`{}`,                            // Neither key
+		`{"number": "MRD-005"}`,         // No release date
+		`{"number": "MRD-006", "releas`, // Truncated
+	} {
+		products = append(products, datastore.Product{ProductLineUrlName: "yugioh",
+			ProductNumber: fmt.Sprintf("MRD-%03d", i+1), CustomAttributes: json.RawMessage(attrs)})
+	}
+	if err := store.AddSetData(ctx, &set, products); err != nil {
+		t.Fatalf("AddSetData() error: %v", err)
+	}
+
+	scanned, failed, err := auditAttributes(ctx, store)
+	if err != nil || scanned != 6 || failed != 5 {
+		t.Errorf("auditAttributes() = %d scanned, %d failed, %v, want 6 scanned, 5 failed", scanned, failed, err)
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want os.FileMode
+		ok   bool
+	}{
+		{"0644", 0o644, true},
+		{"755", 0o755, true},
+		{"0600", 0o600, true},
+		{"0", 0, true},
+		{"0777", 0o777, true},
+		{"01777", 0, false}, // Sticky bit, not permissions
+		{"0648", 0, false},
+		{"rw-r--r--", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseFileMode(tt.mode)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseFileMode(%q) = %v, %v, want %v, ok %t", tt.mode, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStoreImageModes(t *testing.T) {
+	dir := t.TempDir()
+	// Find the umask by creating a file with every permission, since created files and
+	// directories get the configured modes less the umask
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, nil, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	umask := 0o777 &^ info.Mode().Perm()
+
+	tests := []struct {
+		fileMode string
+		dirMode  string
+	}{
+		{"0644", "0755"},
+		{"0600", "0700"},
+		{"0640", "0750"},
+	}
+	for i, tt := range tests {
+		fileMode, _ := parseFileMode(tt.fileMode)
+		dirMode, _ := parseFileMode(tt.dirMode)
+		opts := ImageOptions{store: IMAGE_STORE_FILES, dir: filepath.Join(dir, strconv.Itoa(i)), path: "{set}/{number}",
+			spec: tcapi.DefaultImageSpec, fileMode: fileMode, dirMode: dirMode}
+		p := datastore.Product{ProductId: 1, SetUrlName: "metal-raiders", ProductNumber: "MRD-001"}
+		if err := storeImage(context.Background(), nil, opts, p, []byte{1}); err != nil {
+			t.Fatalf("storeImage() error: %v", err)
+		}
+
+		name := imageFileName(p, opts)
+		for path, want := range map[string]os.FileMode{name: fileMode, filepath.Dir(name): dirMode, opts.dir: dirMode} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Error checking %s: %v", path, err)
+			}
+			if got := info.Mode().Perm(); got != want&^umask {
+				t.Errorf("modes %s and %s: %s has mode %v, want %v", tt.fileMode, tt.dirMode, path, got, want&^umask)
+			}
+		}
+	}
+}
+
+func TestGetSetsNotInDatastoreOrder(t *testing.T) {
+	var names []string
+	var values []string
+	for i := range 20 {
+		names = append(names, fmt.Sprintf("set-%02d", i))
+		values = append(values, fmt.Sprintf(`{"urlValue": "set-%02d", "value": "Set %02d", "count": 10.0}`, i, i))
+	}
+	body := `{"results": [{"aggregations": {"setName": [` + strings.Join(values, ",") + `]}, "results": [], "totalResults": 200}]}`
+	client := tcapi.NewClient()
+	client.SetTransport(tcapi.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{Status: "200 OK", StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}))
+
+	ctx := context.Background()
+	store := datastore.NewInMemoryDataStore()
+	pl := datastore.Product_Line{Name: "YuGiOh", UrlName: "yugioh"}
+	if _, err := store.AddProductLine(ctx, &pl); err != nil {
+		t.Fatalf("AddProductLine() error: %v", err)
+	}
+	for _, stored := range []string{"set-03", "set-10"} {
+		if err := store.AddSetData(ctx, &datastore.Set{Name: stored, UrlName: stored, ProductLineId: pl.Id}, nil); err != nil {
+			t.Fatalf("AddSetData() error: %v", err)
+		}
+	}
+
+	want := slices.DeleteFunc(names, func(name string) bool { return name == "set-03" || name == "set-10" })
+	sets, err := getSetsNotInDatastore(client, &pl, "", store)
+	if err != nil {
+		t.Fatalf("getSetsNotInDatastore() error: %v", err)
+	}
+	var got []string
+	for _, set := range sets {
+		got = append(got, set.UrlName)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("getSetsNotInDatastore() = %v, want the sets not stored in API order %v", got, want)
+	}
+}
+
+func TestPrintProductTableFields(t *testing.T) {
+	set := datastore.Set{Name: "Metal Raiders"}
+	products := []datastore.Product{
+		{ProductId: 101, ProductName: "Feral Imp", ProductNumber: "MRD-001", RarityName: "Common", SetUrlName: "metal-raiders",
+			ReleaseDate: "2002-06-26T00:00:00Z", ReleasedOn: time.Date(2002, time.June, 26, 0, 0, 0, 0, time.UTC)},
+	}
+	fields, err := parseProductFields([]string{"releaseDate", "number", "ID"})
+	if err != nil {
+		t.Fatalf("parseProductFields() error: %v", err)
+	}
+	var buf bytes.Buffer
+	printProductTable(&buf, set, products, fields)
+
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) < 6 {
+		t.Fatalf("printProductTable() printed:\n%s", buf.String())
+	}
+	header, row := strings.Fields(strings.ReplaceAll(lines[2], "|", "")), strings.Fields(strings.ReplaceAll(lines[4], "|", ""))
+	if !slices.Equal(header, []string{"Release", "Date", "Number", "Id"}) || !slices.Equal(row, []string{"2002-06-26", "MRD-001", "101"}) {
+		t.Errorf("printProductTable() header %q, row %q, want only the release date, number, and id in order", header, row)
+	}
+	for _, omitted := range []string{"Feral Imp", "Common", "metal-raiders", "Name", "Rarity"} {
+		if strings.Contains(buf.String(), omitted) {
+			t.Errorf("printProductTable() printed %q, a field not selected:\n%s", omitted, buf.String())
+		}
+	}
+}
+
+func TestParseProductFieldsUnknown(t *testing.T) {
+	for _, names := range [][]string{{"number", "price"}, {}} {
+		_, err := parseProductFields(names)
+		if err == nil {
+			t.Errorf("parseProductFields(%q) succeeded, want an error", names)
+			continue
+		}
+		for _, valid := range productFieldNames() {
+			if !strings.Contains(err.Error(), valid) {
+				t.Errorf("parseProductFields(%q) error %q doesn't list field %s", names, err, valid)
+			}
+		}
+	}
+}
+
+func TestFetchSetImagesResumeSkipsStored(t *testing.T) {
+	ctx := context.Background()
+	store := datastore.NewInMemoryDataStore()
+	set := datastore.Set{Name: "Metal Raiders", UrlName: "metal-raiders"}
+	var prodList []datastore.Product // Products fetched from the TCGPlayer API
+	for i := 1; i <= 3; i++ {
+		prodList = append(prodList, datastore.Product{ProductId: 100 + i, ProductNumber: fmt.Sprintf("MRD-%03d", i),
+			RarityName: "Common", SetName: set.Name})
+	}
+	if err := store.AddSetData(ctx, &set, prodList); err != nil {
+		t.Fatalf("AddSetData() error: %v", err)
+	}
+	products, _ := store.GetProductsBySetIds(ctx, []int{set.Id})
+	recorded, _ := store.GetProductByNumber(ctx, set.Id, "MRD-002")
+	if err := store.AddProductImage(ctx, recorded.ProductId, []byte{1}); err != nil {
+		t.Fatalf("AddProductImage() error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		resume  bool
+		force   bool
+		numbers []string // Numbers of the products whose image is fetched
+	}{
+		{"resume", true, false, []string{"MRD-001", "MRD-003"}},
+		{"no resume", false, false, []string{"MRD-001", "MRD-002", "MRD-003"}},
+		{"resume forced", true, true, []string{"MRD-001", "MRD-002", "MRD-003"}},
+	}
+	for _, tt := range tests {
+		opts := ImageOptions{client: &stubFetcher{}, store: IMAGE_STORE_DB, resume: tt.resume, force: tt.force}
+		res := fetchSetImages(ctx, store, prodList, products, opts)
+		var numbers []string
+		for _, img := range res.images {
+			numbers = append(numbers, img.product.ProductNumber)
+		}
+		slices.Sort(numbers)
+		if !slices.Equal(numbers, tt.numbers) || res.skipped != 3-len(tt.numbers) {
+			t.Errorf("%s: images fetched for %v, %d skipped, want %v", tt.name, numbers, res.skipped, tt.numbers)
+		}
+	}
+}
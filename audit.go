@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gurbos/tcd/datastore"
+)
+
+// auditRecord is a single line of the audit log, recording the products written for a set.
+type auditRecord struct {
+	Time           time.Time `json:"time"`            // When the set's products were committed
+	RunStarted     time.Time `json:"run_started"`     // When the run writing the set started, identifying the run
+	ProductLine    string    `json:"product_line"`    // Url name of the set's product line
+	Set            string    `json:"set"`             // Set name
+	SetUrlName     string    `json:"set_url_name"`    // Set url name
+	SetId          int       `json:"set_id"`          // Data store set id
+	ProductIds     []int     `json:"product_ids"`     // TCGPlayer product ids of the products written
+	ProductNumbers []string  `json:"product_numbers"` // Numbers of the products written, in the same order
+}
+
+// auditLog is an append-only log of the products written by each run, one JSON object per line.
+// Records are written whole and synced to disk one at a time, so a run that crashes leaves every
+// record written before the crash intact.
+type auditLog struct {
+	mu         sync.Mutex // Serializes writes so records never interleave
+	file       *os.File
+	runStarted time.Time
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if it doesn't exist.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening audit log: %w", err)
+	}
+	return &auditLog{file: file, runStarted: time.Now().UTC()}, nil
+}
+
+// Record appends a record of the products written for set and syncs it to disk.
+func (a *auditLog) Record(productLine string, set *datastore.Set, products []datastore.Product) error {
+	rec := auditRecord{
+		Time:           time.Now().UTC(),
+		RunStarted:     a.runStarted,
+		ProductLine:    productLine,
+		Set:            set.Name,
+		SetUrlName:     set.UrlName,
+		SetId:          set.Id,
+		ProductIds:     make([]int, len(products)),
+		ProductNumbers: make([]string, len(products)),
+	}
+	for i, p := range products {
+		rec.ProductIds[i] = p.ProductId
+		rec.ProductNumbers[i] = p.ProductNumber
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Error encoding audit record for set '%s': %w", set.Name, err)
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(line); err != nil { // A single write, so the record is appended whole
+		return fmt.Errorf("Error writing audit record for set '%s': %w", set.Name, err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("Error syncing audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit log file.
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/pflag"
+)
+
+// Environment variables set by the keys of the [db] config file table, keyed by table key
+var dbConfigEnv = map[string]string{
+	"username":         "USERNAME",
+	"password":         "PASSWORD",
+	"host":             "HOST",
+	"port":             "PORT",
+	"db_name":          "DB_NAME",
+	"ssl_mode":         "SSL_MODE",
+	"connect_timeout":  "CONNECT_TIMEOUT",
+	"application_name": "APPLICATION_NAME",
+}
+
+// configEntry is a single key and value read from a config file.
+type configEntry struct {
+	table  string   // Table the key belongs to, empty for top-level keys
+	key    string   // Key name
+	values []string // Value, or each element of an array value
+	line   int      // Line number of the key in the config file
+}
+
+// loadConfigFile reads settings from the TOML file at path. Top-level keys are flag names
+// (with '-' or '_' separators) and set each flag not already given on the command line;
+// array values set list flags such as product-line-name. Keys in the [db] table set the
+// database environment variables read by LoadCredentials, unless already set in the
+// environment. Unknown keys and tables are reported together in the returned error.
+//
+// The whole file is checked before any setting is applied, so nothing is set, in particular
+// no environment variable, when it has errors or unknown keys.
+//
+// Only the subset of TOML needed for settings is supported: comments, table headers, and
+// string, integer, float, boolean, and array values, including multi-line strings and arrays.
+// Nested arrays, inline tables, dotted keys, and dates aren't.
+func loadConfigFile(path string, fs *pflag.FlagSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error opening config file: %w", err)
+	}
+	entries, err := parseConfig(string(data))
+	if err != nil {
+		return fmt.Errorf("Error in config file %s, %w", path, err)
+	}
+
+	var unknown []string
+	for _, e := range entries {
+		known := false
+		switch e.table {
+		case "":
+			name := strings.ReplaceAll(e.key, "_", "-")
+			known = fs.Lookup(name) != nil && name != "config"
+		case "db":
+			_, known = dbConfigEnv[e.key]
+		}
+		if !known {
+			unknown = append(unknown, fmt.Sprintf("%s (line %d)", strings.TrimPrefix(e.table+"."+e.key, "."), e.line))
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("Unknown keys in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	// Set flags before the environment, so an invalid flag value leaves the environment untouched
+	for _, e := range entries {
+		if e.table != "" {
+			continue
+		}
+		name := strings.ReplaceAll(e.key, "_", "-")
+		flag := fs.Lookup(name)
+		if flag.Changed {
+			continue // The command line overrides the config file
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			// Replace list flags element by element, so elements may hold commas
+			if err := slice.Replace(e.values); err != nil {
+				return fmt.Errorf("Error in config file %s, line %d: invalid value for %s: %w", path, e.line, e.key, err)
+			}
+			flag.Changed = true
+			continue
+		}
+		if err := fs.Set(name, strings.Join(e.values, ",")); err != nil {
+			return fmt.Errorf("Error in config file %s, line %d: invalid value for %s: %w", path, e.line, e.key, err)
+		}
+	}
+	for _, e := range entries {
+		if e.table != "db" {
+			continue
+		}
+		env := dbConfigEnv[e.key]
+		if _, found := os.LookupEnv(env); !found { // The environment overrides the config file
+			os.Setenv(env, strings.Join(e.values, ","))
+		}
+	}
+	return nil
+}
+
+// configParser parses the TOML source of a config file, reading from pos.
+type configParser struct {
+	src string
+	pos int
+}
+
+// parseConfig returns the key and value entries of the TOML source, in source order. Errors
+// start with the line number they were found on.
+func parseConfig(src string) ([]configEntry, error) {
+	p := &configParser{src: src}
+	entries, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line(), err)
+	}
+	return entries, nil
+}
+
+func (p *configParser) parse() ([]configEntry, error) {
+	var entries []configEntry
+	var table string
+	seen := make(map[string]bool) // Tables and table qualified keys already defined
+	for {
+		p.skipSpace(true)
+		if p.pos == len(p.src) {
+			return entries, nil
+		}
+
+		if p.src[p.pos] == '[' {
+			p.pos++
+			if strings.HasPrefix(p.src[p.pos:], "[") {
+				return nil, fmt.Errorf("arrays of tables are not supported")
+			}
+			p.skipSpace(false)
+			name, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !strings.HasPrefix(p.src[p.pos:], "]") {
+				return nil, fmt.Errorf("malformed table header")
+			}
+			p.pos++
+			if seen["["+name+"]"] {
+				return nil, fmt.Errorf("table [%s] defined twice", name)
+			}
+			seen["["+name+"]"] = true
+			table = name
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		line := p.line()
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if !strings.HasPrefix(p.src[p.pos:], "=") {
+			return nil, fmt.Errorf("expected key = value")
+		}
+		p.pos++
+		p.skipSpace(false)
+		values, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if seen[table+"."+key] {
+			return nil, fmt.Errorf("key %s defined twice", key)
+		}
+		seen[table+"."+key] = true
+		entries = append(entries, configEntry{table: table, key: key, values: values, line: line})
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// line returns the line number of pos.
+func (p *configParser) line() int {
+	return strings.Count(p.src[:p.pos], "\n") + 1
+}
+
+// skipSpace skips spaces, tabs, and comments, and also newlines if newlines is set.
+func (p *configParser) skipSpace(newlines bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			if end := strings.IndexByte(p.src[p.pos:], '\n'); end >= 0 {
+				p.pos += end
+			} else {
+				p.pos = len(p.src)
+			}
+		case newlines && (c == '\n' || strings.HasPrefix(p.src[p.pos:], "\r\n")):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine skips the spaces and comment ending a line, and the newline, returning an error if
+// anything else follows a key's value or a table header.
+func (p *configParser) endOfLine() error {
+	p.skipSpace(false)
+	rest := p.src[p.pos:]
+	switch {
+	case rest == "":
+	case strings.HasPrefix(rest, "\n"):
+		p.pos++
+	case strings.HasPrefix(rest, "\r\n"):
+		p.pos += 2
+	default:
+		end := strings.IndexAny(rest, "\r\n")
+		if end < 0 {
+			end = len(rest)
+		}
+		return fmt.Errorf("unexpected text after value: %s", rest[:end])
+	}
+	return nil
+}
+
+// key parses a bare or quoted key.
+func (p *configParser) key() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"`) || strings.HasPrefix(p.src[p.pos:], "'") {
+		if strings.HasPrefix(p.src[p.pos:], `"""`) || strings.HasPrefix(p.src[p.pos:], "'''") {
+			return "", fmt.Errorf("keys can't be multi-line strings")
+		}
+		return p.str()
+	}
+	end := p.pos
+	for end < len(p.src) && isBareKeyChar(p.src[end]) {
+		end++
+	}
+	if end == p.pos {
+		return "", fmt.Errorf("expected key = value")
+	}
+	key := p.src[p.pos:end]
+	p.pos = end
+	if strings.HasPrefix(p.src[p.pos:], ".") {
+		return "", fmt.Errorf("dotted keys are not supported")
+	}
+	return key, nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// value parses a value into its string form, or the string form of each element for an array.
+// Arrays may span lines, with comments and a trailing comma.
+func (p *configParser) value() ([]string, error) {
+	if !strings.HasPrefix(p.src[p.pos:], "[") {
+		v, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		return []string{v}, nil
+	}
+
+	p.pos++
+	values := []string{}
+	for {
+		p.skipSpace(true)
+		if strings.HasPrefix(p.src[p.pos:], "]") {
+			p.pos++
+			return values, nil
+		}
+		if strings.HasPrefix(p.src[p.pos:], "[") {
+			return nil, fmt.Errorf("nested arrays are not supported")
+		}
+		v, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipSpace(true)
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], ","):
+			p.pos++
+		case !strings.HasPrefix(p.src[p.pos:], "]"):
+			return nil, fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// scalar parses the string, integer, float, or boolean value at pos into its string form.
+func (p *configParser) scalar() (string, error) {
+	rest := p.src[p.pos:]
+	if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "'") {
+		return p.str()
+	}
+
+	end := strings.IndexAny(rest, ",]# \t\r\n")
+	if end < 0 {
+		end = len(rest)
+	}
+	token := rest[:end]
+	if token == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	if token != "true" && token != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64); err != nil {
+			return "", fmt.Errorf("invalid value %s, strings must be quoted", token)
+		}
+		token = strings.ReplaceAll(token, "_", "")
+	}
+	p.pos += end
+	return token, nil
+}
+
+// str parses the basic, literal, or multi-line string at pos, resolving TOML escapes in basic
+// strings. A newline right after the opening quotes of a multi-line string is trimmed.
+func (p *configParser) str() (string, error) {
+	rest := p.src[p.pos:]
+	quote := rest[:1]
+	multiLine := strings.HasPrefix(rest, strings.Repeat(quote, 3))
+	delim := quote
+	if multiLine {
+		delim = strings.Repeat(quote, 3)
+		p.pos += 3
+		if strings.HasPrefix(p.src[p.pos:], "\n") {
+			p.pos++
+		} else if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+			p.pos += 2
+		}
+	} else {
+		p.pos++
+	}
+
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += len(delim)
+			// Up to two quotes ending a multi-line string are part of it
+			for i := 0; multiLine && i < 2 && strings.HasPrefix(p.src[p.pos:], quote); i++ {
+				b.WriteString(quote)
+				p.pos++
+			}
+			return b.String(), nil
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '\n' && !multiLine:
+			return "", fmt.Errorf("unterminated string")
+		case c == '\\' && quote == `"`:
+			if err := p.escape(&b, multiLine); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// escape resolves the TOML escape sequence at pos, writing the character it stands for to b. In
+// a multi-line string, a backslash ending a line trims the newline and following whitespace.
+func (p *configParser) escape(b *strings.Builder, multiLine bool) error {
+	p.pos++ // The backslash
+	if multiLine {
+		end := p.pos
+		for end < len(p.src) && (p.src[end] == ' ' || p.src[end] == '\t') {
+			end++
+		}
+		if strings.HasPrefix(p.src[end:], "\n") || strings.HasPrefix(p.src[end:], "\r\n") {
+			p.pos = end
+			for p.pos < len(p.src) && strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])) {
+				p.pos++
+			}
+			return nil
+		}
+	}
+	if p.pos == len(p.src) {
+		return fmt.Errorf("unterminated string")
+	}
+
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"':
+		b.WriteByte('"')
+	case '\\':
+		b.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("invalid escape \\%c in string", c)
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid escape \\%c%s in string", c, p.src[p.pos:p.pos+n])
+		}
+		b.WriteRune(rune(code))
+		p.pos += n
+	default:
+		return fmt.Errorf("invalid escape \\%c in string", c)
+	}
+	return nil
+}
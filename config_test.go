@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// newConfigFlagSet returns a flag set with a few of the flags of each kind the config file
+// sets, parsed from args.
+func newConfigFlagSet(t *testing.T, args ...string) *pflag.FlagSet {
+	t.Helper()
+	fs := pflag.NewFlagSet("tcd", pflag.ContinueOnError)
+	fs.String("pl", "yugioh", "")
+	fs.Int("limit", 0, "")
+	fs.Bool("upsert", false, "")
+	fs.StringSlice("product-line-name", nil, "")
+	fs.StringArray("header", nil, "")
+	fs.String("config", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Error parsing flags: %v", err)
+	}
+	return fs
+}
+
+// writeConfig writes a config file holding src to a temporary directory, returning its path.
+func writeConfig(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tcd.toml")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFileFlagOverride(t *testing.T) {
+	fs := newConfigFlagSet(t, "--pl", "magic")
+	path := writeConfig(t, "pl = \"pokemon\" # Overridden by the command line\nlimit = 5\nupsert = true\n")
+	if err := loadConfigFile(path, fs); err != nil {
+		t.Fatalf("loadConfigFile() error: %v", err)
+	}
+	for name, want := range map[string]string{"pl": "magic", "limit": "5", "upsert": "true"} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("--%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFileArrays(t *testing.T) {
+	fs := newConfigFlagSet(t)
+	path := writeConfig(t, `product_line_name = [
+	"yugioh",   # Comments and a trailing comma are allowed
+	'magic, the gathering',
+]
+header = ["Accept: application/json", "X-Note: \"quoted\" \u00e9"]
+`)
+	if err := loadConfigFile(path, fs); err != nil {
+		t.Fatalf("loadConfigFile() error: %v", err)
+	}
+	lines, _ := fs.GetStringSlice("product-line-name")
+	if !slices.Equal(lines, []string{"yugioh", "magic, the gathering"}) {
+		t.Errorf("--product-line-name = %q, want the elements kept whole", lines)
+	}
+	headers, _ := fs.GetStringArray("header")
+	if !slices.Equal(headers, []string{"Accept: application/json", `X-Note: "quoted" é`}) {
+		t.Errorf("--header = %q, want the escapes resolved", headers)
+	}
+}
+
+func TestLoadConfigFileUnknownKeys(t *testing.T) {
+	t.Setenv("DB_NAME", "")
+	os.Unsetenv("DB_NAME")
+	fs := newConfigFlagSet(t)
+	path := writeConfig(t, "limt = 5\nconfig = \"other.toml\"\n\n[db]\ndb_name = \"tcd\"\nusr = \"tcd\"\n\n[cache]\ndir = \"/tmp\"\n")
+	err := loadConfigFile(path, fs)
+	if err == nil {
+		t.Fatal("loadConfigFile() succeeded, want unknown keys reported")
+	}
+	for _, key := range []string{"limt (line 1)", "config (line 2)", "db.usr (line 6)", "cache.dir (line 9)"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q doesn't report %s", err, key)
+		}
+	}
+	if _, found := os.LookupEnv("DB_NAME"); found {
+		t.Errorf("DB_NAME set from a config file with unknown keys")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		values []string // Values of the only key, nil if the source is invalid
+	}{
+		{"basic string escapes", `k = "a\tb\\c\u0041\U0001F600"`, []string{"a\tb\\cA\U0001F600"}},
+		{"literal string", `k = 'C:\dir\n'`, []string{`C:\dir\n`}},
+		{"multi-line basic string", "k = \"\"\"\nfirst\nsecond \\\n    third\"\"\"", []string{"first\nsecond third"}},
+		{"multi-line literal string", "k = '''\n\\no\nescapes'''", []string{"\\no\nescapes"}},
+		{"numbers and booleans", "k = [1_000, -2.5e3, true]", []string{"1000", "-2.5e3", "true"}},
+		{"empty array", "k = []", []string{}},
+		{"Go escape", `k = "\x41"`, nil},
+		{"unterminated string", "k = \"abc\nd\"", nil},
+		{"unquoted string", "k = abc", nil},
+		{"unterminated array", "k = [1, 2", nil},
+		{"duplicate key", "k = 1\nk = 2", nil},
+		{"text after value", `k = "a" "b"`, nil},
+		{"dotted key", "db.k = 1", nil},
+	}
+	for _, tt := range tests {
+		entries, err := parseConfig(tt.src)
+		if tt.values == nil {
+			if err == nil {
+				t.Errorf("%s: parseConfig() = %+v, want an error", tt.name, entries)
+			}
+			continue
+		}
+		if err != nil || len(entries) != 1 || entries[0].key != "k" || !slices.Equal(entries[0].values, tt.values) {
+			t.Errorf("%s: parseConfig() = %+v, %v, want k = %q", tt.name, entries, err, tt.values)
+		}
+	}
+}
@@ -15,12 +15,17 @@ const (
 	SerializationFailureError = "40001"
 )
 
+const (
+	DefaultMaxConnLifetime       = time.Minute * 10
+	DefaultMaxConnLifetimeJitter = DefaultMaxConnLifetime / 10 // Spreads connection expiry to avoid reconnect stampedes
+)
+
 // Config creates pgxpool.Config with defualt settings provided
-// by the parameters.
-func Config(dsn string) *pgxpool.Config {
+// by the parameters. lifetimeJitter is the maximum random duration added
+// to each connection's lifetime.
+func Config(dsn string, lifetimeJitter time.Duration) *pgxpool.Config {
 	const defaultMaxConns = int32(8)
 	const defaultMinConns = int32(2)
-	const defaultMaxConnLifetime = time.Minute * 10
 	const defaultMaxIdletime = time.Minute * 5
 	const defaultHealthCheckPeriod = time.Minute
 	const defaultConnectTimeout = time.Second * 5
@@ -32,10 +37,13 @@ func Config(dsn string) *pgxpool.Config {
 
 	config.MaxConns = defaultMaxConns
 	config.MinConns = defaultMinConns
-	config.MaxConnLifetime = defaultMaxConnLifetime
+	config.MaxConnLifetime = DefaultMaxConnLifetime
+	config.MaxConnLifetimeJitter = lifetimeJitter
 	config.MaxConnIdleTime = defaultMaxIdletime
 	config.HealthCheckPeriod = defaultHealthCheckPeriod
-	config.ConnConfig.ConnectTimeout = defaultConnectTimeout
+	if config.ConnConfig.ConnectTimeout == 0 { // Keep a connect_timeout given in the dsn
+		config.ConnConfig.ConnectTimeout = defaultConnectTimeout
+	}
 	return config
 }
 
@@ -43,12 +51,35 @@ func Config(dsn string) *pgxpool.Config {
 func NewDBPool(ctx context.Context, config *pgxpool.Config) (*pgxpool.Pool, error) {
 	cp, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("Error in NewDBPool: %w", err)
+		return nil, fmt.Errorf("Error in NewDBPool: %w", classifyError(err))
 	}
 	return cp, nil
 }
 
-// Initialize a new PostgresDataRepository with a connection pool.
-func NewPostgresDataStore(pool *pgxpool.Pool) *PostgresDataStore {
-	return &PostgresDataStore{cp: pool}
+// Initialize a new PostgresDataRepository with a connection pool. Each repository
+// method call is bounded by queryTimeout; a non-positive value disables the timeout.
+func NewPostgresDataStore(pool *pgxpool.Pool, queryTimeout time.Duration) *PostgresDataStore {
+	return &PostgresDataStore{cp: pool, queryTimeout: queryTimeout, batchSize: DefaultBatchSize}
+}
+
+// SetBatchSize sets the maximum number of product inserts sent to the database in a single
+// batch. A non-positive size sends all of a call's products in one batch.
+func (r *PostgresDataStore) SetBatchSize(size int) {
+	r.batchSize = size
+}
+
+// Close closes the store's connection pool, waiting for acquired connections to be released.
+func (r *PostgresDataStore) Close() {
+	r.cp.Close()
+}
+
+// Ping verifies that a connection to the database can be acquired and is responsive.
+func (r *PostgresDataStore) Ping(ctx context.Context) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if err := r.cp.Ping(ctx); err != nil {
+		return fmt.Errorf("Error pinging database: %w", classifyError(err))
+	}
+	return nil
 }
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"errors"
+	"net"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Kinds of data store errors. Errors returned by the data stores wrap one of these when the
+// cause is recognized, so callers can test for them with errors.Is.
+var (
+	ErrNotFound             = errors.New("not found")             // No row matches the query
+	ErrDuplicate            = errors.New("duplicate key")         // A unique constraint was violated
+	ErrSerializationFailure = errors.New("serialization failure") // A serializable transaction conflicted, retrying may succeed
+	ErrConnection           = errors.New("connection failure")    // The database could not be reached
+)
+
+// Error is a data store error of a recognized kind. Both Kind and the underlying error, such
+// as a *pgconn.PgError holding the details of a constraint violation, are matched by errors.Is
+// and errors.As.
+type Error struct {
+	Kind error // One of ErrNotFound, ErrDuplicate, ErrSerializationFailure, or ErrConnection
+	Err  error // Underlying error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// classifyError wraps err in an *Error if its kind is recognized, and otherwise returns err
+// unchanged. Errors already classified are returned unchanged.
+func classifyError(err error) error {
+	var classified *Error
+	if err == nil || errors.As(err, &classified) {
+		return err
+	}
+
+	var kind error
+	var pgErr *pgconn.PgError
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		kind = ErrNotFound
+	case errors.As(err, &pgErr) && pgErr.Code == UniqueViolationError:
+		kind = ErrDuplicate
+	case errors.As(err, &pgErr) && pgErr.Code == SerializationFailureError:
+		kind = ErrSerializationFailure
+	case errors.As(err, &connectErr), errors.As(err, &netErr):
+		kind = ErrConnection
+	default:
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
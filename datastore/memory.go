@@ -0,0 +1,505 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// InMemoryDataStore is a data store holding product lines, sets, products, and product images in
+// memory. It mirrors the behavior of PostgresDataStore, including its unique constraints and
+// not found errors, so it can stand in for a database when one isn't available.
+type InMemoryDataStore struct {
+	mu            sync.Mutex
+	productLines  []Product_Line
+	sets          []Set
+	products      []Product
+	images        map[int][]byte // Image data keyed by product id
+	nextSetId     int
+	nextProductId int
+}
+
+// Initialize a new, empty InMemoryDataStore.
+func NewInMemoryDataStore() *InMemoryDataStore {
+	return &InMemoryDataStore{images: make(map[int][]byte)}
+}
+
+// Close is a no-op; an InMemoryDataStore holds no external resources.
+func (m *InMemoryDataStore) Close() {}
+
+// Ping always succeeds.
+func (m *InMemoryDataStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// uniqueViolation returns an ErrDuplicate error matching the one returned by Postgres for a unique
+// constraint violation on the specified key columns and values.
+func uniqueViolation(columns string, values ...any) error {
+	vals := make([]string, len(values))
+	for i, v := range values {
+		vals[i] = fmt.Sprint(v)
+	}
+	return classifyError(&pgconn.PgError{
+		Code:   UniqueViolationError,
+		Detail: fmt.Sprintf("Key (%s)=(%s) already exists.", columns, strings.Join(vals, ", ")),
+	})
+}
+
+func (m *InMemoryDataStore) GetProductLineByName(ctx context.Context, name string) (Product_Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pl := range m.productLines {
+		if pl.UrlName == name {
+			return pl, nil
+		}
+	}
+	return Product_Line{}, fmt.Errorf("Error scanning product line row: %w", classifyError(pgx.ErrNoRows))
+}
+
+func (m *InMemoryDataStore) GetProductLineById(ctx context.Context, productLineId int) (Product_Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pl := range m.productLines {
+		if pl.Id == productLineId {
+			return pl, nil
+		}
+	}
+	return Product_Line{}, fmt.Errorf("Error scanning product line row for id %d: %w", productLineId, classifyError(pgx.ErrNoRows))
+}
+
+func (m *InMemoryDataStore) GetSetsByProductLineId(ctx context.Context, productLineId int) ([]Set, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sets []Set
+	for _, s := range m.sets {
+		if s.ProductLineId == productLineId {
+			sets = append(sets, s)
+		}
+	}
+	return sets, nil
+}
+
+func (m *InMemoryDataStore) GetSetByUrlName(ctx context.Context, urlName string) (Set, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sets {
+		if s.UrlName == urlName {
+			var productCount int
+			for _, p := range m.products {
+				if p.SetId == s.Id {
+					productCount++
+				}
+			}
+			return s, productCount, nil
+		}
+	}
+	return Set{}, 0, fmt.Errorf("Error scanning set row for url name '%s': %w", urlName, classifyError(pgx.ErrNoRows))
+}
+
+func (m *InMemoryDataStore) GetSetsReleasedBetween(ctx context.Context, productLineId int, start, end time.Time) ([]Set, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sets []Set
+	for _, s := range m.sets {
+		if s.ProductLineId == productLineId && !s.ReleasedOn.IsZero() &&
+			!s.ReleasedOn.Before(start) && !s.ReleasedOn.After(end) {
+			sets = append(sets, s)
+		}
+	}
+	slices.SortStableFunc(sets, func(a, b Set) int { return a.ReleasedOn.Compare(b.ReleasedOn) })
+	return sets, nil
+}
+
+func (m *InMemoryDataStore) ListSetsWithStoredCounts(ctx context.Context, productLineId int) ([]SetWithCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sets []SetWithCount
+	for _, s := range m.sets {
+		if s.ProductLineId != productLineId {
+			continue
+		}
+		sc := SetWithCount{Set: s}
+		for _, p := range m.products {
+			if p.SetId == s.Id {
+				sc.StoredCount++
+			}
+		}
+		sets = append(sets, sc)
+	}
+	slices.SortStableFunc(sets, func(a, b SetWithCount) int {
+		aDiffers, bDiffers := a.StoredCount != a.Count, b.StoredCount != b.Count
+		if aDiffers != bDiffers {
+			if aDiffers {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return sets, nil
+}
+
+func (m *InMemoryDataStore) GetProductsBySetName(ctx context.Context, setName string) ([]Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var products []Product
+	for _, p := range m.products {
+		if p.SetName == setName {
+			products = append(products, p)
+		}
+	}
+	return products, nil
+}
+
+func (m *InMemoryDataStore) GetProductsBySetIds(ctx context.Context, setIds []int) ([]Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var products []Product
+	for _, p := range m.products {
+		if slices.Contains(setIds, p.SetId) {
+			products = append(products, p)
+		}
+	}
+	slices.SortStableFunc(products, func(a, b Product) int {
+		if a.SetId != b.SetId {
+			return a.SetId - b.SetId
+		}
+		return a.ProductId - b.ProductId
+	})
+	return products, nil
+}
+
+func (m *InMemoryDataStore) GetProductByNumber(ctx context.Context, setId int, number string) (Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.products {
+		if p.SetId == setId && p.ProductNumber == number {
+			return p, nil
+		}
+	}
+	return Product{}, fmt.Errorf("Error scanning product row for number '%s' in set %d: %w", number, setId, classifyError(pgx.ErrNoRows))
+}
+
+// EachProduct calls fn for every stored product in product id order. The store is not locked
+// while fn runs, so fn may call other store methods.
+func (m *InMemoryDataStore) EachProduct(ctx context.Context, fn func(Product) error) error {
+	m.mu.Lock()
+	products := slices.Clone(m.products)
+	m.mu.Unlock()
+
+	for _, p := range products {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *InMemoryDataStore) SearchProducts(ctx context.Context, criteria ProductQuery) ([]Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var products []Product
+	for _, p := range m.products {
+		switch {
+		case criteria.ProductLineId != 0 && p.ProductLineId != criteria.ProductLineId:
+		case criteria.SetId != 0 && p.SetId != criteria.SetId:
+		case criteria.RarityName != "" && p.RarityName != criteria.RarityName:
+		case criteria.PrintEdition != "" && p.PrintEdition != criteria.PrintEdition:
+		case criteria.NameContains != "" &&
+			!strings.Contains(strings.ToLower(p.ProductName), strings.ToLower(criteria.NameContains)):
+		default:
+			products = append(products, p)
+		}
+	}
+
+	products = products[min(criteria.Offset, len(products)):]
+	if criteria.Limit > 0 && criteria.Limit < len(products) {
+		products = products[:criteria.Limit]
+	}
+	return products, nil
+}
+
+func (m *InMemoryDataStore) GetProductsByProductLineId(ctx context.Context, productLineId int) ([]Product, error) {
+	return m.SearchProducts(ctx, ProductQuery{ProductLineId: productLineId})
+}
+
+func (m *InMemoryDataStore) GetProductImage(ctx context.Context, productId int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.images[productId]
+	if !ok {
+		return nil, fmt.Errorf("Error scanning image for product %d: %w", productId, classifyError(pgx.ErrNoRows))
+	}
+	return data, nil
+}
+
+func (m *InMemoryDataStore) AddProductLine(ctx context.Context, pl *Product_Line) (*Product_Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.productLines {
+		if existing.UrlName == pl.UrlName {
+			return pl, fmt.Errorf("Error inserting product line: %w",
+				uniqueViolation("product_line_url_name", pl.UrlName))
+		}
+	}
+	pl.Id = len(m.productLines) + 1
+	m.productLines = append(m.productLines, *pl)
+	return pl, nil
+}
+
+func (m *InMemoryDataStore) AddProductLines(ctx context.Context, pls []Product_Line) ([]Product_Line, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range pls {
+		pl := &pls[i]
+		idx := slices.IndexFunc(m.productLines, func(existing Product_Line) bool {
+			return existing.UrlName == pl.UrlName || existing.Name == pl.Name
+		})
+		if idx >= 0 {
+			*pl = m.productLines[idx] // Already stored, return the stored product line
+			continue
+		}
+		pl.Id = len(m.productLines) + 1
+		m.productLines = append(m.productLines, *pl)
+	}
+	return pls, nil
+}
+
+func (m *InMemoryDataStore) AddSets(ctx context.Context, sets []Set, continueOnError bool) ([]SetResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]SetResult, len(sets))
+	for i, set := range sets {
+		results[i] = SetResult{Set: set, Err: ErrSetNotStored}
+	}
+
+	// Validate every set before storing any, so a failure stores nothing unless continueOnError is set
+	var failed int
+	for i := range results {
+		res := &results[i]
+		res.Err = m.checkSet(res.Set)
+		if res.Err == nil {
+			// Check the set against the sets ahead of it in this call as well
+			for _, prev := range results[:i] {
+				if prev.Err == nil && (prev.Set.Name == res.Set.Name || prev.Set.UrlName == res.Set.UrlName) {
+					res.Err = uniqueViolation("set_url_name", res.Set.UrlName)
+				}
+			}
+		}
+		if res.Err != nil {
+			res.Err = fmt.Errorf("Error inserting set '%s': %w", res.Set.UrlName, res.Err)
+			failed++
+			if !continueOnError {
+				for j := range results[:i] {
+					results[j].Err = ErrSetNotStored // Nothing is stored after a failure
+				}
+				return results, fmt.Errorf("Error inserting sets, rolled back: %w", res.Err)
+			}
+		}
+	}
+	for i := range results {
+		if results[i].Err == nil {
+			m.insertSet(&results[i].Set)
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d sets failed to insert", failed, len(sets))
+	}
+	return results, nil
+}
+
+func (m *InMemoryDataStore) AddProducts(ctx context.Context, products []Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkProducts(products, 0); err != nil {
+		return err
+	}
+	m.insertProducts(products, 0)
+	return nil
+}
+
+// AddSetData inserts set and its products. Like PostgresDataStore, nothing is stored unless the
+// set and every product can be inserted.
+func (m *InMemoryDataStore) AddSetData(ctx context.Context, set *Set, products []Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkSet(*set); err != nil {
+		return fmt.Errorf("Error inserting set '%s' in AddSetData(): %w", set.Name, err)
+	}
+	if err := m.checkProducts(products, m.nextSetId+1); err != nil {
+		return fmt.Errorf("Error inserting products for set %s in AddSetData(): %w", set.Name, err)
+	}
+	m.insertSet(set)
+	m.insertProducts(products, set.Id)
+	return nil
+}
+
+// AddProductsForSet inserts products for the already stored set with id setId. Like
+// PostgresDataStore, nothing is stored unless the set exists and every product can be inserted.
+func (m *InMemoryDataStore) AddProductsForSet(ctx context.Context, setId int, products []Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !slices.ContainsFunc(m.sets, func(s Set) bool { return s.Id == setId }) {
+		return fmt.Errorf("Error fetching set %d in AddProductsForSet(): %w", setId, classifyError(pgx.ErrNoRows))
+	}
+	if err := m.checkProducts(products, setId); err != nil {
+		return fmt.Errorf("Error inserting products for set %d in AddProductsForSet(): %w", setId, err)
+	}
+	m.insertProducts(products, setId)
+	return nil
+}
+
+// UpsertSetData stores set and its products like AddSetData, but updates the set, matched by
+// url name, and products, matched by key, that are already stored instead of failing.
+func (m *InMemoryDataStore) UpsertSetData(ctx context.Context, set *Set, products []Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := slices.IndexFunc(m.sets, func(s Set) bool { return s.UrlName == set.UrlName })
+	if idx < 0 {
+		if err := m.checkSet(*set); err != nil {
+			return fmt.Errorf("Error upserting set '%s' in UpsertSetData(): %w", set.Name, err)
+		}
+		m.insertSet(set)
+	} else {
+		stored := &m.sets[idx]
+		stored.Count, stored.ReleaseDate, stored.ReleasedOn = set.Count, set.ReleaseDate, set.ReleasedOn
+		set.Id = stored.Id
+	}
+
+	for _, p := range products {
+		p.SetId = set.Id
+		idx := slices.IndexFunc(m.products, func(stored Product) bool {
+			return stored.ProductNumber == p.ProductNumber && stored.RarityName == p.RarityName && stored.SetId == p.SetId
+		})
+		if idx < 0 {
+			m.insertProducts([]Product{p}, 0)
+			continue
+		}
+		p.ProductId = m.products[idx].ProductId // Keep the stored product id
+		m.products[idx] = p
+	}
+	return nil
+}
+
+func (m *InMemoryDataStore) UpdateSetCount(ctx context.Context, setId int, count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.sets {
+		if m.sets[i].Id == setId {
+			m.sets[i].Count = count
+			return nil
+		}
+	}
+	return fmt.Errorf("Error updating count of set %d: %w", setId, classifyError(pgx.ErrNoRows))
+}
+
+func (m *InMemoryDataStore) GetProductImageIds(ctx context.Context, productIds []int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for _, id := range productIds {
+		if _, ok := m.images[id]; ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (m *InMemoryDataStore) AddProductImage(ctx context.Context, productId int, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.images[productId] = slices.Clone(data)
+	return nil
+}
+
+// checkSet returns a unique violation error if set's name or url name is already stored.
+func (m *InMemoryDataStore) checkSet(set Set) error {
+	for _, s := range m.sets {
+		if s.Name == set.Name {
+			return uniqueViolation("set_name", set.Name)
+		}
+		if s.UrlName == set.UrlName {
+			return uniqueViolation("set_url_name", set.UrlName)
+		}
+	}
+	return nil
+}
+
+// insertSet stores set, assigning its id.
+func (m *InMemoryDataStore) insertSet(set *Set) {
+	m.nextSetId++
+	set.Id = m.nextSetId
+	m.sets = append(m.sets, *set)
+}
+
+// productStoreKey is the primary key of a stored product.
+type productStoreKey struct {
+	number string
+	rarity string
+	setId  int
+}
+
+// checkProducts returns a unique violation error if any of products, or two products within
+// products, share a primary key. If setId is non-zero it is used in place of each product's SetId.
+func (m *InMemoryDataStore) checkProducts(products []Product, setId int) error {
+	seen := make(map[productStoreKey]struct{}, len(m.products)+len(products))
+	for _, p := range m.products {
+		seen[productStoreKey{p.ProductNumber, p.RarityName, p.SetId}] = struct{}{}
+	}
+	for _, p := range products {
+		if setId != 0 {
+			p.SetId = setId
+		}
+		key := productStoreKey{p.ProductNumber, p.RarityName, p.SetId}
+		if _, exists := seen[key]; exists {
+			return uniqueViolation("product_number, rarity_name, set_id", p.ProductNumber, p.RarityName, p.SetId)
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
+// insertProducts stores products, assigning their product ids. If setId is non-zero it is used
+// in place of each product's SetId. The caller's products are not modified.
+func (m *InMemoryDataStore) insertProducts(products []Product, setId int) {
+	for _, p := range products {
+		if setId != 0 {
+			p.SetId = setId
+		}
+		m.nextProductId++
+		p.ProductId = m.nextProductId
+		m.products = append(m.products, p)
+	}
+}
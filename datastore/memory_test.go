@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// newTestStore returns an InMemoryDataStore holding a set with two products.
+func newTestStore(t *testing.T) (*InMemoryDataStore, Set) {
+	t.Helper()
+	m := NewInMemoryDataStore()
+	set := Set{Name: "Metal Raiders", UrlName: "metal-raiders", Count: 2}
+	products := []Product{
+		{ProductNumber: "MRD-001", RarityName: "Common"},
+		{ProductNumber: "MRD-002", RarityName: "Rare"},
+	}
+	if err := m.AddSetData(context.Background(), &set, products); err != nil {
+		t.Fatalf("AddSetData() error: %v", err)
+	}
+	return m, set
+}
+
+func TestInMemoryDataStoreDuplicates(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		add    func(m *InMemoryDataStore, set Set) error
+		detail string // Detail of the unique violation
+	}{
+		{"set name", func(m *InMemoryDataStore, set Set) error {
+			return m.AddSetData(ctx, &Set{Name: set.Name, UrlName: "other"}, nil)
+		}, "Key (set_name)=(Metal Raiders) already exists."},
+		{"set url name", func(m *InMemoryDataStore, set Set) error {
+			return m.AddSetData(ctx, &Set{Name: "Other", UrlName: set.UrlName}, nil)
+		}, "Key (set_url_name)=(metal-raiders) already exists."},
+		{"stored product", func(m *InMemoryDataStore, set Set) error {
+			return m.AddProductsForSet(ctx, set.Id, []Product{{ProductNumber: "MRD-001", RarityName: "Common"}})
+		}, "Key (product_number, rarity_name, set_id)=(MRD-001, Common, 1) already exists."},
+		{"product within the call", func(m *InMemoryDataStore, set Set) error {
+			p := Product{ProductNumber: "MRD-003", RarityName: "Common"}
+			return m.AddProductsForSet(ctx, set.Id, []Product{p, p})
+		}, "Key (product_number, rarity_name, set_id)=(MRD-003, Common, 1) already exists."},
+		{"product line", func(m *InMemoryDataStore, set Set) error {
+			if _, err := m.AddProductLine(ctx, &Product_Line{Name: "YuGiOh", UrlName: "yugioh"}); err != nil {
+				return err
+			}
+			_, err := m.AddProductLine(ctx, &Product_Line{Name: "YuGiOh", UrlName: "yugioh"})
+			return err
+		}, "Key (product_line_url_name)=(yugioh) already exists."},
+	}
+	for _, tt := range tests {
+		m, set := newTestStore(t)
+		err := tt.add(m, set)
+		var pgErr *pgconn.PgError
+		if !errors.Is(err, ErrDuplicate) || !errors.As(err, &pgErr) || pgErr.Detail != tt.detail {
+			t.Errorf("%s: error = %v, want ErrDuplicate with detail %q", tt.name, err, tt.detail)
+		}
+		if products, _ := m.GetProductsBySetIds(ctx, []int{set.Id}); len(products) != 2 {
+			t.Errorf("%s: %d products stored after a failed insert, want 2", tt.name, len(products))
+		}
+	}
+}
+
+func TestInMemoryDataStoreNotFound(t *testing.T) {
+	ctx := context.Background()
+	m, set := newTestStore(t)
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"GetProductLineByName", func() error { _, err := m.GetProductLineByName(ctx, "yugioh"); return err }()},
+		{"GetProductLineById", func() error { _, err := m.GetProductLineById(ctx, 1); return err }()},
+		{"GetSetByUrlName", func() error { _, _, err := m.GetSetByUrlName(ctx, "spell-ruler"); return err }()},
+		{"GetProductByNumber", func() error { _, err := m.GetProductByNumber(ctx, set.Id, "MRD-999"); return err }()},
+		{"GetProductImage", func() error { _, err := m.GetProductImage(ctx, 1); return err }()},
+		{"UpdateSetCount", m.UpdateSetCount(ctx, set.Id+1, 5)},
+		{"AddProductsForSet", m.AddProductsForSet(ctx, set.Id+1, []Product{{ProductNumber: "SRL-001"}})},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, ErrNotFound) {
+			t.Errorf("%s error = %v, want ErrNotFound", tt.name, tt.err)
+		}
+	}
+	if products, _ := m.GetProductsBySetIds(ctx, []int{set.Id + 1}); len(products) != 0 {
+		t.Errorf("AddProductsForSet() stored %d products for a missing set", len(products))
+	}
+}
+
+func TestInMemoryDataStoreUpsertSetData(t *testing.T) {
+	ctx := context.Background()
+	m, set := newTestStore(t)
+	stored, _ := m.GetProductByNumber(ctx, set.Id, "MRD-001")
+
+	upsert := Set{Name: set.Name, UrlName: set.UrlName, Count: 3}
+	products := []Product{
+		{ProductNumber: "MRD-001", RarityName: "Common", ProductName: "Feral Imp"}, // Updated
+		{ProductNumber: "MRD-003", RarityName: "Common"},                           // Inserted
+	}
+	if err := m.UpsertSetData(ctx, &upsert, products); err != nil {
+		t.Fatalf("UpsertSetData() error: %v", err)
+	}
+	if upsert.Id != set.Id {
+		t.Errorf("upserted set id = %d, want the stored id %d", upsert.Id, set.Id)
+	}
+	gotSet, count, err := m.GetSetByUrlName(ctx, set.UrlName)
+	if err != nil || gotSet.Count != 3 || count != 3 {
+		t.Errorf("GetSetByUrlName() = %+v, %d products, %v, want count 3 and 3 products", gotSet, count, err)
+	}
+	updated, err := m.GetProductByNumber(ctx, set.Id, "MRD-001")
+	if err != nil || updated.ProductName != "Feral Imp" || updated.ProductId != stored.ProductId {
+		t.Errorf("updated product = %+v, %v, want name Feral Imp and product id %d", updated, err, stored.ProductId)
+	}
+	if _, err := m.GetProductByNumber(ctx, set.Id, "MRD-003"); err != nil {
+		t.Errorf("inserted product not stored: %v", err)
+	}
+}
+
+func TestInMemoryDataStoreAddProductsForSet(t *testing.T) {
+	ctx := context.Background()
+	m, set := newTestStore(t)
+	products := []Product{
+		{ProductNumber: "MRD-003", RarityName: "Common", SetId: 99}, // SetId is replaced by the set's id
+		{ProductNumber: "MRD-001", RarityName: "Ultra Rare"},        // Same number, different rarity
+	}
+	if err := m.AddProductsForSet(ctx, set.Id, products); err != nil {
+		t.Fatalf("AddProductsForSet() error: %v", err)
+	}
+	if products[0].SetId != 99 {
+		t.Errorf("AddProductsForSet() modified the caller's products")
+	}
+	if _, count, _ := m.GetSetByUrlName(ctx, set.UrlName); count != 4 {
+		t.Errorf("set has %d products, want 4", count)
+	}
+	if p, err := m.GetProductByNumber(ctx, set.Id, "MRD-003"); err != nil || p.SetId != set.Id {
+		t.Errorf("GetProductByNumber() = %+v, %v, want a product of set %d", p, err, set.Id)
+	}
+}
@@ -2,22 +2,53 @@ package datastore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const (
+	DefaultQueryTimeout = 30 * time.Second // Default deadline for a single repository method call
+	rollbackTimeout     = 5 * time.Second  // Deadline for rolling back a transaction after its context ends
+	DefaultBatchSize    = 500              // Default number of product inserts sent in a single batch
+)
+
 type PostgresDataStore struct {
-	cp *pgxpool.Pool // Connection pool to the PostgreSQL database
+	cp           *pgxpool.Pool // Connection pool to the PostgreSQL database
+	queryTimeout time.Duration // Deadline applied to each repository method call
+	batchSize    int           // Maximum number of product inserts sent in a single batch
+}
+
+// withTimeout derives a context bounded by the store's query timeout. If ctx already
+// carries an earlier deadline, that deadline is kept.
+func (r *PostgresDataStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
+
+// rollback rolls back tx using a context detached from ctx's cancellation, so the
+// rollback still runs after the query timeout has expired.
+func rollback(ctx context.Context, tx pgx.Tx) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+	tx.Rollback(ctx)
 }
 
 func (r *PostgresDataStore) GetProductLineByName(ctx context.Context, name string) (Product_Line, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	var productLine Product_Line // Holds query result
 
 	c, err := r.cp.Acquire(ctx)
 	if err != nil {
-		return productLine, fmt.Errorf("Error acquiring connection from pool: %w", err)
+		return productLine, fmt.Errorf("Error acquiring connection from pool: %w", classifyError(err))
 	}
 	defer c.Release()
 
@@ -26,13 +57,63 @@ func (r *PostgresDataStore) GetProductLineByName(ctx context.Context, name strin
 	)
 
 	if err := row.Scan(&productLine.Id, &productLine.Name, &productLine.UrlName); err != nil {
-		return productLine, fmt.Errorf("Error scanning product line row: %w", err)
+		return productLine, fmt.Errorf("Error scanning product line row: %w", classifyError(err))
 	}
 
 	return productLine, nil
 }
 
+// GetProductLineById returns the product line with id productLineId. An error wrapping
+// ErrNotFound is returned if there is none.
+func (r *PostgresDataStore) GetProductLineById(ctx context.Context, productLineId int) (Product_Line, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var productLine Product_Line // Holds query result
+	row := r.cp.QueryRow(ctx,
+		"SELECT product_line_id, product_line_name, product_line_url_name FROM product_lines WHERE product_line_id=$1;", productLineId,
+	)
+	if err := row.Scan(&productLine.Id, &productLine.Name, &productLine.UrlName); err != nil {
+		return productLine, fmt.Errorf("Error scanning product line row for id %d: %w", productLineId, classifyError(err))
+	}
+	return productLine, nil
+}
+
+// GetSetByUrlName returns the set with the specified url name along with the number of
+// products stored for it. The returned error wraps ErrNotFound if no set matches.
+func (r *PostgresDataStore) GetSetByUrlName(ctx context.Context, urlName string) (Set, int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var set Set          // Holds query result
+	var productCount int // Holds count of products stored for the set
+
+	c, err := r.cp.Acquire(ctx)
+	if err != nil {
+		return set, 0, fmt.Errorf("Error acquiring connection from pool: %w", classifyError(err))
+	}
+	defer c.Release()
+
+	sql := "SELECT s.set_id, s.set_name, s.set_url_name, s.card_count, s.release_date, s.product_line_id, s.released_on, " +
+		"(SELECT COUNT(*) FROM products p WHERE p.set_id = s.set_id) " +
+		"FROM sets s WHERE s.set_url_name=$1;"
+	row := c.QueryRow(ctx, sql, urlName)
+	var releasedOn *time.Time
+	err = row.Scan(&set.Id, &set.Name, &set.UrlName, &set.Count, &set.ReleaseDate, &set.ProductLineId, &releasedOn, &productCount)
+	if releasedOn != nil {
+		set.ReleasedOn = *releasedOn
+	}
+	if err != nil {
+		return set, 0, fmt.Errorf("Error scanning set row for url name '%s': %w", urlName, classifyError(err))
+	}
+
+	return set, productCount, nil
+}
+
 func (r *PostgresDataStore) GetSetsByProductLineId(ctx context.Context, ProductLineId int) ([]Set, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	// Begin a transaction with serializable isolation level
 	// which guarantees a fully consistent view of database state
 	// throughout the transaction, preventing concurrency anomolies.
@@ -41,21 +122,21 @@ func (r *PostgresDataStore) GetSetsByProductLineId(ctx context.Context, ProductL
 	}
 	tx, err := r.cp.BeginTx(ctx, txOptions)
 	if err != nil {
-		return nil, fmt.Errorf("Error acquiring connection from pool: %w", err)
+		return nil, fmt.Errorf("Error acquiring connection from pool: %w", classifyError(err))
 	}
-	defer tx.Rollback(ctx)
+	defer rollback(ctx, tx)
 
 	// Get count of sets for the specified product line
 	var setCount int
 	if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM sets").Scan(&setCount); err != nil {
-		return nil, fmt.Errorf("Error counting sets:%w", err)
+		return nil, fmt.Errorf("Error counting sets:%w", classifyError(err))
 	}
 
 	// Query sets by product line name
-	sql := "SELECT * FROM sets WHERE product_line_id=$1;"
+	sql := "SELECT " + setColumns + " FROM sets WHERE product_line_id=$1;"
 	rows, err := tx.Query(ctx, sql, ProductLineId)
 	if err != nil {
-		return nil, fmt.Errorf("Error querying sets by product line id %d: %w\n", ProductLineId, err)
+		return nil, fmt.Errorf("Error querying sets by product line id %d: %w\n", ProductLineId, classifyError(err))
 	}
 
 	// Scan rows into set list
@@ -64,26 +145,125 @@ func (r *PostgresDataStore) GetSetsByProductLineId(ctx context.Context, ProductL
 		if !rows.Next() {
 			break
 		}
-		s := &sets[i]
-		err := rows.Scan(&s.Id, &s.Name, &s.UrlName, &s.Count, &s.ReleaseDate, &s.ProductLineId)
+		s, err := scanSet(rows)
+		sets[i] = s
 		if err != nil {
-			return nil, fmt.Errorf("Error scanning set rows for product line id %d: %w\n", ProductLineId, err)
+			return nil, fmt.Errorf("Error scanning set rows for product line id %d: %w\n", ProductLineId, classifyError(err))
 		}
 	}
 	// Check if loop ended due to errer or end of rows
 	if rows.Err() != nil {
-		return nil, fmt.Errorf("Error iterating through set rows for product line id %d: %w\n", ProductLineId, err)
+		return nil, fmt.Errorf("Error iterating through set rows for product line id %d: %w\n", ProductLineId, classifyError(err))
 	}
 	rows.Close()
 
 	if err := tx.Commit(ctx); err != nil {
-		return nil, fmt.Errorf("Error commiting query read operations of sets for product line id %d: %w", ProductLineId, err)
+		return nil, fmt.Errorf("Error commiting query read operations of sets for product line id %d: %w", ProductLineId, classifyError(err))
 	}
 
 	return sets, nil
 }
 
+// ListSetsWithStoredCounts returns the sets of the product line, each with the number of products
+// stored for it. Sets whose stored count differs from their card count are returned first, so
+// incompletely scraped sets surface immediately; within each group sets are ordered by name.
+func (r *PostgresDataStore) ListSetsWithStoredCounts(ctx context.Context, productLineId int) ([]SetWithCount, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sql := "SELECT s.set_id, s.set_name, s.set_url_name, s.card_count, s.release_date, s.product_line_id, s.released_on, " +
+		"COUNT(p.product_id) AS stored_count " +
+		"FROM sets s LEFT JOIN products p ON p.set_id = s.set_id " +
+		"WHERE s.product_line_id=$1 GROUP BY s.set_id " +
+		"ORDER BY COUNT(p.product_id) <> s.card_count DESC, s.set_name;"
+	rows, err := r.cp.Query(ctx, sql, productLineId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying set counts for product line id %d: %w", productLineId, classifyError(err))
+	}
+	defer rows.Close()
+
+	var sets []SetWithCount
+	for rows.Next() {
+		var s SetWithCount
+		var releasedOn *time.Time
+		err := rows.Scan(&s.Id, &s.Name, &s.UrlName, &s.Count, &s.ReleaseDate, &s.ProductLineId, &releasedOn, &s.StoredCount)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning set count row: %w", classifyError(err))
+		}
+		if releasedOn != nil {
+			s.ReleasedOn = *releasedOn
+		}
+		sets = append(sets, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through set count rows: %w", classifyError(err))
+	}
+	return sets, nil
+}
+
+// GetSetsReleasedBetween returns the sets of the product line released between start and end,
+// inclusive, ordered by release date ascending. Sets without a parsed release date are excluded.
+func (r *PostgresDataStore) GetSetsReleasedBetween(ctx context.Context, productLineId int, start, end time.Time) ([]Set, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sql := "SELECT " + setColumns + " FROM sets " +
+		"WHERE product_line_id=$1 AND released_on BETWEEN $2 AND $3 ORDER BY released_on, set_id;"
+	rows, err := r.cp.Query(ctx, sql, productLineId, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying sets released between %s and %s: %w",
+			start.Format(time.DateOnly), end.Format(time.DateOnly), classifyError(err))
+	}
+	defer rows.Close()
+
+	var sets []Set
+	for rows.Next() {
+		s, err := scanSet(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning set row: %w", classifyError(err))
+		}
+		sets = append(sets, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through set rows: %w", classifyError(err))
+	}
+	return sets, nil
+}
+
+// GetProductsBySetIds returns the products of every set in setIds with a single query, ordered
+// by set id and then product id so callers can group them by set.
+func (r *PostgresDataStore) GetProductsBySetIds(ctx context.Context, setIds []int) ([]Product, error) {
+	if len(setIds) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sql := "SELECT " + productColumns + " FROM products WHERE set_id = ANY($1) ORDER BY set_id, product_id;"
+	rows, err := r.cp.Query(ctx, sql, setIds)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying product rows by set ids: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning product row: %w", classifyError(err))
+		}
+		products = append(products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through product rows: %w", classifyError(err))
+	}
+	return products, nil
+}
+
 func (r *PostgresDataStore) GetProductsBySetName(ctx context.Context, setName string) ([]Product, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	var rowCount int // Holds count of products for the specified set
 
 	// Begin a transaction with serializable isolation level
@@ -98,40 +278,35 @@ func (r *PostgresDataStore) GetProductsBySetName(ctx context.Context, setName st
 	if err != nil {
 		return nil, fmt.Errorf("Error beginning DB transaction")
 	}
-	defer tx.Rollback(ctx)
+	defer rollback(ctx, tx)
 
 	// Get count of rows to be returned in the query following this one
 	row := tx.QueryRow(ctx, "SELECT COUNT(*) FROM products WHERE set_name=$1;", setName)
 	err = row.Scan(&rowCount)
 
 	// Get all products in set specified in setName
-	sql := "SELECT * FROM products WHERE set_name=$1;"
+	sql := "SELECT " + productColumns + " FROM products WHERE set_name=$1;"
 	rows, err := tx.Query(ctx, sql, setName)
 	if err != nil {
-		return nil, fmt.Errorf("Error querying product rows by set name '%s': %w\n", setName, err)
+		return nil, fmt.Errorf("Error querying product rows by set name '%s': %w\n", setName, classifyError(err))
 	}
 
 	// Scan rows into product list
 	products := make([]Product, rowCount) // Create slice to hold products
 	var i int
 	for rows.Next() {
-		p := &products[i]
+		p, err := scanProduct(rows)
+		products[i] = p
 		i++
-		err := rows.Scan(
-			&p.ProductId, &p.ProductName, &p.ProductUrlName, &p.ProductLineName,
-			&p.ProductLineUrlName, &p.RarityName, &p.CustomAttributes,
-			&p.SetName, &p.SetUrlName, &p.ProductNumber, &p.PrintEdition,
-			&p.ReleaseDate, &p.ProductLineId, &p.SetId,
-		)
 		if err != nil {
-			return nil, fmt.Errorf("Error scanning product row for set name '%s': %w\n", setName, err)
+			return nil, fmt.Errorf("Error scanning product row for set name '%s': %w\n", setName, classifyError(err))
 		}
 
 	}
 	// Check if loop ended due to errer or end of rows
 	rowsErr := rows.Err()
 	if rowsErr != nil {
-		return nil, fmt.Errorf("Error iterating through product rows for set '%s': %w\n", setName, rowsErr)
+		return nil, fmt.Errorf("Error iterating through product rows for set '%s': %w\n", setName, classifyError(rowsErr))
 	}
 
 	// Commit transaction
@@ -142,11 +317,194 @@ func (r *PostgresDataStore) GetProductsBySetName(ctx context.Context, setName st
 	return products, nil
 }
 
+// GetProductByNumber returns the product with the specified product number in the set with
+// the specified set id. Product numbers are unique within a set.
+func (r *PostgresDataStore) GetProductByNumber(ctx context.Context, setId int, number string) (Product, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	c, err := r.cp.Acquire(ctx)
+	if err != nil {
+		return Product{}, fmt.Errorf("Error acquiring connection from pool: %w", classifyError(err))
+	}
+	defer c.Release()
+
+	sql := "SELECT " + productColumns + " FROM products WHERE set_id=$1 AND product_number=$2 LIMIT 1;"
+	p, err := scanProduct(c.QueryRow(ctx, sql, setId, number))
+	if err != nil {
+		return p, fmt.Errorf("Error scanning product row for number '%s' in set %d: %w", number, setId, classifyError(err))
+	}
+	return p, nil
+}
+
+// EachProduct streams every stored product, ordered by product id, to fn. Iteration stops at the
+// first error returned by fn, which is returned to the caller.
+func (r *PostgresDataStore) EachProduct(ctx context.Context, fn func(Product) error) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	c, err := r.cp.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("Error acquiring connection from pool: %w", classifyError(err))
+	}
+	defer c.Release()
+
+	sql := "SELECT " + productColumns + " FROM products ORDER BY product_id;"
+	rows, err := c.Query(ctx, sql)
+	if err != nil {
+		return fmt.Errorf("Error querying product rows: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return fmt.Errorf("Error scanning product row: %w", classifyError(err))
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error iterating through product rows: %w", classifyError(err))
+	}
+	return nil
+}
+
+// SearchProducts returns the products matching every filter set in criteria, ordered by
+// product id and paginated by criteria.Limit and criteria.Offset.
+func (r *PostgresDataStore) SearchProducts(ctx context.Context, criteria ProductQuery) ([]Product, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// Build WHERE clause from the filters that are set, with parameterized values
+	var conds []string
+	var args []any
+	addCond := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if criteria.ProductLineId != 0 {
+		addCond("product_line_id=$%d", criteria.ProductLineId)
+	}
+	if criteria.SetId != 0 {
+		addCond("set_id=$%d", criteria.SetId)
+	}
+	if criteria.RarityName != "" {
+		addCond("rarity_name=$%d", criteria.RarityName)
+	}
+	if criteria.PrintEdition != "" {
+		addCond("print_edition=$%d", criteria.PrintEdition)
+	}
+	if criteria.NameContains != "" {
+		addCond("product_name ILIKE '%%' || $%d || '%%'", criteria.NameContains)
+	}
+
+	sql := "SELECT " + productColumns + " FROM products"
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	sql += " ORDER BY product_id"
+	if criteria.Limit > 0 {
+		args = append(args, criteria.Limit)
+		sql += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if criteria.Offset > 0 {
+		args = append(args, criteria.Offset)
+		sql += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := r.cp.Query(ctx, sql+";", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error searching products: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Error scanning product row: %w", classifyError(err))
+		}
+		products = append(products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through product rows: %w", classifyError(err))
+	}
+	return products, nil
+}
+
+// GetProductsByProductLineId returns every product in the specified product line. Products are
+// read in pages of productPageSize through SearchProducts, so no single query returns the
+// whole product line.
+func (r *PostgresDataStore) GetProductsByProductLineId(ctx context.Context, productLineId int) ([]Product, error) {
+	const productPageSize = 1000
+
+	var products []Product
+	query := ProductQuery{ProductLineId: productLineId, Limit: productPageSize}
+	for {
+		page, err := r.SearchProducts(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching products for product line id %d: %w", productLineId, classifyError(err))
+		}
+		products = append(products, page...)
+		if len(page) < productPageSize {
+			return products, nil
+		}
+		query.Offset += productPageSize
+	}
+}
+
+// productColumns lists the products table columns in the order scanned by scanProduct.
+const productColumns = "product_id, product_name, product_url_name, product_line_name, " +
+	"product_line_url_name, rarity_name, custom_attributes, set_name, set_url_name, " +
+	"product_number, print_edition, release_date, product_line_id, set_id, attributes, raw_product, released_on"
+
+// scanProduct scans a row selected with productColumns into a Product.
+func scanProduct(row pgx.Row) (Product, error) {
+	var p Product
+	var releasedOn *time.Time
+	err := row.Scan(
+		&p.ProductId, &p.ProductName, &p.ProductUrlName, &p.ProductLineName,
+		&p.ProductLineUrlName, &p.RarityName, &p.CustomAttributes,
+		&p.SetName, &p.SetUrlName, &p.ProductNumber, &p.PrintEdition,
+		&p.ReleaseDate, &p.ProductLineId, &p.SetId, &p.Attributes, &p.Raw, &releasedOn,
+	)
+	if releasedOn != nil {
+		p.ReleasedOn = *releasedOn
+	}
+	return p, err
+}
+
+const setColumns = "set_id, set_name, set_url_name, card_count, release_date, product_line_id, released_on"
+
+// scanSet scans a row selected with setColumns into a Set.
+func scanSet(row pgx.Row) (Set, error) {
+	var s Set
+	var releasedOn *time.Time
+	err := row.Scan(&s.Id, &s.Name, &s.UrlName, &s.Count, &s.ReleaseDate, &s.ProductLineId, &releasedOn)
+	if releasedOn != nil {
+		s.ReleasedOn = *releasedOn
+	}
+	return s, err
+}
+
+// nullTime returns t as a query argument, or nil to store NULL if t is the zero time.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
 // AddProductLine adds a new product line to the database and returns the added product line with its assigned ID.
 func (r *PostgresDataStore) AddProductLine(ctx context.Context, pl *Product_Line) (*Product_Line, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	c, err := r.cp.Acquire(ctx)
 	if err != nil {
-		return pl, fmt.Errorf("error acquiring connection from pool: %w", err)
+		return pl, fmt.Errorf("error acquiring connection from pool: %w", classifyError(err))
 	}
 	defer c.Release()
 
@@ -154,163 +512,398 @@ func (r *PostgresDataStore) AddProductLine(ctx context.Context, pl *Product_Line
 		"VALUES ($1, $2) RETURNING *;"
 	err = c.QueryRow(ctx, sql, pl.Name, pl.UrlName).Scan(&pl.Id, &pl.Name, &pl.UrlName)
 	if err != nil {
-		return pl, fmt.Errorf("Error inserting product line: %w", err)
+		return pl, fmt.Errorf("Error inserting product line: %w", classifyError(err))
 	}
 	return pl, nil
 }
 
-// AddSets adds multiple sets to the database in a single batch operation.
-// Returns the list of sets with their assigned IDs after insertion.
-func (r *PostgresDataStore) AddSets(ctx context.Context, sets []Set) ([]Set, error) {
+// AddProductLines inserts product lines in a single batch and returns them with their assigned
+// ids. Product lines that already exist are not inserted again; they are returned with their
+// stored ids, so existing lines don't abort the batch.
+func (r *PostgresDataStore) AddProductLines(ctx context.Context, pls []Product_Line) ([]Product_Line, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
 
 	tx, err := r.cp.Begin(ctx)
 	if err != nil {
-		return sets, fmt.Errorf("Error beginning DB transaction: %w", err)
+		return pls, fmt.Errorf("Error beginning DB transaction: %w", classifyError(err))
+	}
+	defer rollback(ctx, tx)
+
+	// Rows that conflict with an existing product line return no row instead of an error
+	sql := "INSERT INTO product_lines (product_line_name, product_line_url_name) VALUES ($1, $2) " +
+		"ON CONFLICT DO NOTHING RETURNING product_line_id, product_line_name, product_line_url_name;"
+	batch := &pgx.Batch{}
+	for _, pl := range pls {
+		batch.Queue(sql, pl.Name, pl.UrlName)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	var existing []int // Indexes of product lines that were already stored
+	for i := range pls {
+		pl := &pls[i]
+		err := results.QueryRow().Scan(&pl.Id, &pl.Name, &pl.UrlName)
+		if errors.Is(err, pgx.ErrNoRows) {
+			existing = append(existing, i)
+		} else if err != nil {
+			results.Close()
+			return pls, fmt.Errorf("Error inserting product line '%s': %w", pl.UrlName, classifyError(err))
+		}
+	}
+	if err := results.Close(); err != nil {
+		return pls, fmt.Errorf("Error closing batch results: %w", classifyError(err))
 	}
-	defer tx.Rollback(ctx)
 
-	// String stores SQL statement  to be executed
-	sql := "INSERT INTO sets (set_name, set_url_name, card_count, release_date, product_line_id) " +
-		"VALUES ($1, $2, $3, $4, $5) RETURNING *;"
-	batch := &pgx.Batch{} // Create a new batch for batch execution
-	for _, set := range sets {
-		batch.Queue(sql, set.Name, set.UrlName, set.Count, "", set.ProductLineId)
+	// Look up the ids of product lines that were already stored
+	for _, i := range existing {
+		pl := &pls[i]
+		row := tx.QueryRow(ctx, "SELECT product_line_id, product_line_name, product_line_url_name FROM product_lines "+
+			"WHERE product_line_url_name=$1 OR product_line_name=$2;", pl.UrlName, pl.Name)
+		if err := row.Scan(&pl.Id, &pl.Name, &pl.UrlName); err != nil {
+			return pls, fmt.Errorf("Error scanning existing product line '%s': %w", pl.UrlName, classifyError(err))
+		}
 	}
 
-	// Send the batch to the database
-	batchResults := tx.SendBatch(ctx, batch)
+	if err := tx.Commit(ctx); err != nil {
+		return pls, fmt.Errorf("Error committing DB transaction: %w", classifyError(err))
+	}
+	return pls, nil
+}
 
-	// Process batch results
-	var isError bool // Flag to track if any errors occurred during batch execution
-	for i := 0; i < batch.Len(); i++ {
-		row := batchResults.QueryRow()
-		// Scan newly inserted rows into set list to retrieve assigned IDs
-		err := row.Scan(
-			&sets[i].Id, &sets[i].Name, &sets[i].UrlName,
-			&sets[i].Count, &sets[i].ReleaseDate, &sets[i].ProductLineId,
-		)
-		if err != nil {
-			isError = true
-			fmt.Println(
-				fmt.Errorf("Error scanning inserted set '%s': %w\n", sets[i].UrlName, err),
-			)
-		}
+// AddSets inserts sets in a single transaction and returns a result for each set, holding the set
+// with its assigned id and any error inserting it. If continueOnError is false, the first failure
+// rolls back every set and the other sets' results hold ErrSetNotStored. If continueOnError is
+// true, each set is inserted under its own savepoint, so failed sets are skipped and the rest
+// are committed.
+func (r *PostgresDataStore) AddSets(ctx context.Context, sets []Set, continueOnError bool) ([]SetResult, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	results := make([]SetResult, len(sets))
+	for i, set := range sets {
+		results[i] = SetResult{Set: set, Err: ErrSetNotStored}
 	}
 
-	if isError {
-		return sets, fmt.Errorf("One or more errors occurred during batch insert of sets")
+	tx, err := r.cp.Begin(ctx)
+	if err != nil {
+		return results, fmt.Errorf("Error beginning DB transaction: %w", classifyError(err))
 	}
+	defer rollback(ctx, tx)
+
+	// String stores SQL statement  to be executed
+	sql := "INSERT INTO sets (set_name, set_url_name, card_count, release_date, product_line_id, released_on) " +
+		"VALUES ($1, $2, $3, $4, $5, $6) RETURNING " + setColumns + ";"
 
-	if err := batchResults.Close(); err != nil {
-		return sets, fmt.Errorf("Error closing batch results:")
+	var failed int // Number of sets that failed to insert
+	for i := range results {
+		res := &results[i]
+		sp, err := tx.Begin(ctx) // Savepoint so a failed insert doesn't abort the transaction
+		if err != nil {
+			return results, fmt.Errorf("Error creating savepoint: %w", classifyError(err))
+		}
+		set := res.Set
+		res.Set, res.Err = scanSet(sp.QueryRow(ctx, sql,
+			set.Name, set.UrlName, set.Count, set.ReleaseDate, set.ProductLineId, nullTime(set.ReleasedOn)))
+		if res.Err != nil {
+			res.Set = set
+			res.Err = fmt.Errorf("Error inserting set '%s': %w", set.UrlName, classifyError(res.Err))
+			rollback(ctx, sp)
+			failed++
+			if !continueOnError {
+				for j := range results[:i] {
+					results[j].Err = ErrSetNotStored // Earlier sets are rolled back with the transaction
+				}
+				return results, fmt.Errorf("Error inserting sets, rolled back: %w", classifyError(res.Err))
+			}
+			continue
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return results, fmt.Errorf("Error releasing savepoint: %w", classifyError(err))
+		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return sets, fmt.Errorf("Error committing DB transaction: %w", err)
+		return results, fmt.Errorf("Error committing DB transaction: %w", classifyError(err))
 	}
 
-	return sets, nil
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d sets failed to insert", failed, len(sets))
+	}
+	return results, nil
 }
 
+// AddProducts inserts products in chunks of the store's batch size, each committed in its own
+// transaction. If a chunk fails, earlier chunks remain committed.
 func (r *PostgresDataStore) AddProducts(ctx context.Context, products []Product) error {
-	tx, err := r.cp.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("error beginning DB transaction: %w", err)
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	for _, chunk := range chunkProducts(products, r.batchSize) {
+		tx, err := r.cp.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("error beginning DB transaction: %w", classifyError(err))
+		}
+
+		if err := insertProducts(ctx, tx, productInsertSql, chunk, 0); err != nil {
+			rollback(ctx, tx)
+			return classifyError(err)
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			rollback(ctx, tx)
+			return fmt.Errorf("Error committing DB transaction: %w", classifyError(err))
+		}
 	}
-	defer tx.Rollback(ctx)
 
-	// SQL statement  to be executed
-	sql := "INSERT INTO products (product_name, product_url_name, product_line_name, " +
-		"product_line_url_name, rarity_name, custom_attributes, set_name, set_url_name, " +
-		"product_number, print_edition, release_date, product_line_id, set_id) " +
-		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);"
+	return nil
+}
 
-	batch := &pgx.Batch{} // Create a new batch for batch execution
-	for _, product := range products {
-		batch.Queue(
-			sql,
-			product.ProductName, product.ProductUrlName, product.ProductLineName,
-			product.ProductLineUrlName, product.RarityName, product.CustomAttributes,
-			product.SetName, product.SetUrlName, product.ProductNumber, product.PrintEdition,
-			product.ReleaseDate, product.ProductLineId, product.SetId,
-		)
+// AddSetData inserts set and its products in a single transaction. Products are sent in chunks
+// of the store's batch size, but nothing is committed unless every chunk succeeds.
+func (r *PostgresDataStore) AddSetData(ctx context.Context, set *Set, products []Product) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	txOptions := pgx.TxOptions{
+		IsoLevel: pgx.Serializable,
 	}
+	tx, err := r.cp.BeginTx(ctx, txOptions)
+	if err != nil {
+		return fmt.Errorf("Error beginning DB transaction: %w", classifyError(err))
+	}
+	defer rollback(ctx, tx)
 
-	// Send the batch to the database
-	br := tx.SendBatch(ctx, batch)
-	defer br.Close()
+	setSql := "INSERT INTO sets (set_name, set_url_name, card_count, release_date, product_line_id, released_on) " +
+		"VALUES ($1, $2, $3, $4, $5, $6) RETURNING set_id;"
 
-	// Process batch results
-	for i := 0; i < batch.Len(); i++ {
-		_, brErr := br.Exec()
-		if brErr != nil {
-			return brErr
-		}
+	row := tx.QueryRow(ctx, setSql, set.Name, set.UrlName, set.Count, set.ReleaseDate, set.ProductLineId, nullTime(set.ReleasedOn))
+	if err := row.Scan(&set.Id); err != nil {
+		return fmt.Errorf("Error inserting set '%s' in AddSetData(): %w", set.Name, classifyError(err))
 	}
 
-	if err := br.Close(); err != nil {
-		return fmt.Errorf("Error closing batch results: %w", err)
+	// Insert products in chunks within the set's transaction, so the set and its products are
+	// committed together
+	for _, chunk := range chunkProducts(products, r.batchSize) {
+		if err := insertProducts(ctx, tx, productInsertSql, chunk, set.Id); err != nil {
+			return fmt.Errorf("Error inserting products for set %s in AddSetData(): %w", set.Name, classifyError(err))
+		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("Error committing DB transaction: %w", err)
+		return fmt.Errorf("Error committing DB transaction in AddSetData(): %w", classifyError(err))
 	}
 
 	return nil
 }
 
-func (r *PostgresDataStore) AddSetData(ctx context.Context, set *Set, products []Product) error {
+// AddProductsForSet inserts products for the already stored set with id setId in a single
+// transaction, without inserting the set. Products are sent in chunks of at most the store's
+// batch size. An error wrapping ErrNotFound is returned if no set has id setId.
+func (r *PostgresDataStore) AddProductsForSet(ctx context.Context, setId int, products []Product) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	txOptions := pgx.TxOptions{
+		IsoLevel: pgx.Serializable,
+	}
+	tx, err := r.cp.BeginTx(ctx, txOptions)
+	if err != nil {
+		return fmt.Errorf("Error beginning DB transaction: %w", classifyError(err))
+	}
+	defer rollback(ctx, tx)
+
+	// Lock the set so it can't be deleted before its products are committed
+	row := tx.QueryRow(ctx, "SELECT set_id FROM sets WHERE set_id=$1 FOR SHARE;", setId)
+	if err := row.Scan(&setId); err != nil {
+		return fmt.Errorf("Error fetching set %d in AddProductsForSet(): %w", setId, classifyError(err))
+	}
+
+	for _, chunk := range chunkProducts(products, r.batchSize) {
+		if err := insertProducts(ctx, tx, productInsertSql, chunk, setId); err != nil {
+			return fmt.Errorf("Error inserting products for set %d in AddProductsForSet(): %w", setId, classifyError(err))
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Error committing DB transaction in AddProductsForSet(): %w", classifyError(err))
+	}
+	return nil
+}
+
+// UpsertSetData stores set and its products in a single transaction, like AddSetData, but
+// updates the set and products that are already stored instead of failing. An existing set,
+// matched by url name, keeps its set id and has its count and release date updated; existing
+// products, matched by primary key, keep their product id and have their other columns updated.
+func (r *PostgresDataStore) UpsertSetData(ctx context.Context, set *Set, products []Product) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
 	txOptions := pgx.TxOptions{
 		IsoLevel: pgx.Serializable,
 	}
 	tx, err := r.cp.BeginTx(ctx, txOptions)
 	if err != nil {
-		return fmt.Errorf("Error beginning DB transaction: %w", err)
+		return fmt.Errorf("Error beginning DB transaction: %w", classifyError(err))
 	}
-	defer tx.Rollback(ctx)
+	defer rollback(ctx, tx)
 
-	setSql := "INSERT INTO sets (set_name, set_url_name, card_count, release_date, product_line_id) " +
-		"VALUES ($1, $2, $3, $4, $5) RETURNING set_id;"
+	setSql := "INSERT INTO sets (set_name, set_url_name, card_count, release_date, product_line_id, released_on) " +
+		"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (set_url_name) DO UPDATE SET card_count = EXCLUDED.card_count, " +
+		"release_date = EXCLUDED.release_date, released_on = EXCLUDED.released_on RETURNING set_id;"
 
-	row := tx.QueryRow(ctx, setSql, set.Name, set.UrlName, set.Count, set.ReleaseDate, set.ProductLineId)
+	row := tx.QueryRow(ctx, setSql, set.Name, set.UrlName, set.Count, set.ReleaseDate, set.ProductLineId, nullTime(set.ReleasedOn))
 	if err := row.Scan(&set.Id); err != nil {
-		return fmt.Errorf("Error inserting set '%s' in AddSetData(): %w", set.Name, err)
+		return fmt.Errorf("Error upserting set '%s' in UpsertSetData(): %w", set.Name, classifyError(err))
 	}
 
-	productSql := "INSERT INTO products (product_name, product_url_name, product_line_name, " +
-		"product_line_url_name, rarity_name, custom_attributes, set_name, set_url_name, " +
-		"product_number, print_edition, release_date, product_line_id, set_id) " +
-		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);"
+	for _, chunk := range chunkProducts(products, r.batchSize) {
+		if err := insertProducts(ctx, tx, productUpsertSql, chunk, set.Id); err != nil {
+			return fmt.Errorf("Error upserting products for set %s in UpsertSetData(): %w", set.Name, classifyError(err))
+		}
+	}
 
-	batch := &pgx.Batch{} // Create a new batch for batch execution
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Error committing DB transaction in UpsertSetData(): %w", classifyError(err))
+	}
+
+	return nil
+}
+
+// UpdateSetCount sets the card count of the set with the specified set id. The returned error
+// wraps ErrNotFound if no set has the id.
+func (r *PostgresDataStore) UpdateSetCount(ctx context.Context, setId int, count int) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.cp.Exec(ctx, "UPDATE sets SET card_count = $1 WHERE set_id = $2;", count, setId)
+	if err != nil {
+		return fmt.Errorf("Error updating count of set %d: %w", setId, classifyError(err))
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("Error updating count of set %d: %w", setId, classifyError(pgx.ErrNoRows))
+	}
+	return nil
+}
+
+// AddProductImage stores image data for the product with the specified product id, replacing
+// any image previously stored for it.
+func (r *PostgresDataStore) AddProductImage(ctx context.Context, productId int, data []byte) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sql := "INSERT INTO product_images (product_id, image_data, fetched_at) VALUES ($1, $2, now()) " +
+		"ON CONFLICT (product_id) DO UPDATE SET image_data = EXCLUDED.image_data, fetched_at = EXCLUDED.fetched_at;"
+	if _, err := r.cp.Exec(ctx, sql, productId, data); err != nil {
+		return fmt.Errorf("Error inserting image for product %d: %w", productId, classifyError(err))
+	}
+	return nil
+}
+
+// GetProductImage returns the image data stored for the product with the specified product id.
+func (r *PostgresDataStore) GetProductImage(ctx context.Context, productId int) ([]byte, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var data []byte
+	sql := "SELECT image_data FROM product_images WHERE product_id=$1;"
+	if err := r.cp.QueryRow(ctx, sql, productId).Scan(&data); err != nil {
+		return nil, fmt.Errorf("Error scanning image for product %d: %w", productId, classifyError(err))
+	}
+	return data, nil
+}
+
+// GetProductImageIds returns the ids, of those in productIds, of the products with an image
+// stored, with a single query.
+func (r *PostgresDataStore) GetProductImageIds(ctx context.Context, productIds []int) ([]int, error) {
+	if len(productIds) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sql := "SELECT product_id FROM product_images WHERE product_id = ANY($1) ORDER BY product_id;"
+	rows, err := r.cp.Query(ctx, sql, productIds)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying image rows by product ids: %w", classifyError(err))
+	}
+	defer rows.Close()
 
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Error scanning image row: %w", classifyError(err))
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating through image rows: %w", classifyError(err))
+	}
+	return ids, nil
+}
+
+// productValuesSql inserts a single product row; productInsertSql and productUpsertSql complete it.
+const productValuesSql = "INSERT INTO products (product_name, product_url_name, product_line_name, " +
+	"product_line_url_name, rarity_name, custom_attributes, set_name, set_url_name, " +
+	"product_number, print_edition, release_date, product_line_id, set_id, attributes, raw_product, released_on) " +
+	"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)"
+
+// productInsertSql inserts a single product row, failing if it is already stored.
+const productInsertSql = productValuesSql + ";"
+
+// productUpsertSql inserts a single product row, updating the stored row if one has the same key.
+const productUpsertSql = productValuesSql + " ON CONFLICT (product_number, rarity_name, set_id) DO UPDATE SET " +
+	"product_name = EXCLUDED.product_name, product_url_name = EXCLUDED.product_url_name, " +
+	"product_line_name = EXCLUDED.product_line_name, product_line_url_name = EXCLUDED.product_line_url_name, " +
+	"custom_attributes = EXCLUDED.custom_attributes, set_name = EXCLUDED.set_name, " +
+	"set_url_name = EXCLUDED.set_url_name, print_edition = EXCLUDED.print_edition, " +
+	"release_date = EXCLUDED.release_date, product_line_id = EXCLUDED.product_line_id, " +
+	"attributes = EXCLUDED.attributes, raw_product = EXCLUDED.raw_product, released_on = EXCLUDED.released_on;"
+
+// insertProducts sends products to the database within tx as a single batch, each with sql,
+// productInsertSql or productUpsertSql. If setId is non-zero it is used as the set_id of every
+// product in place of the product's SetId.
+func insertProducts(ctx context.Context, tx pgx.Tx, sql string, products []Product, setId int) error {
+	batch := &pgx.Batch{} // Create a new batch for batch execution
 	for _, p := range products {
+		productSetId := p.SetId
+		if setId != 0 {
+			productSetId = setId
+		}
 		batch.Queue(
-			productSql,
+			sql,
 			p.ProductName, p.ProductUrlName, p.ProductLineName,
 			p.ProductLineUrlName, p.RarityName, p.CustomAttributes,
 			p.SetName, p.SetUrlName, p.ProductNumber, p.PrintEdition,
-			p.ReleaseDate, p.ProductLineId, set.Id,
+			p.ReleaseDate, p.ProductLineId, productSetId, p.Attributes, p.Raw, nullTime(p.ReleasedOn),
 		)
 	}
 
 	br := tx.SendBatch(ctx, batch)
 	defer br.Close()
 
+	// Process batch results
 	for i := 0; i < batch.Len(); i++ {
-		_, brErr := br.Exec()
-		if brErr != nil {
-			return fmt.Errorf("Error inserting products for set %s in AddSetData(): %w", set.Name, brErr)
+		if _, err := br.Exec(); err != nil {
+			return err
 		}
 	}
 
 	if err := br.Close(); err != nil {
-		return fmt.Errorf("Error closing batch results in AddSetData(): %w", err)
+		return fmt.Errorf("Error closing batch results: %w", classifyError(err))
 	}
+	return nil
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("Error committing DB transaction in AddSetData(): %w", err)
+// chunkProducts splits products into consecutive chunks of at most size products. A
+// non-positive size returns all products in a single chunk.
+func chunkProducts(products []Product, size int) [][]Product {
+	if size <= 0 || len(products) <= size {
+		return [][]Product{products}
 	}
-
-	return nil
+	chunks := make([][]Product, 0, (len(products)+size-1)/size)
+	for start := 0; start < len(products); start += size {
+		chunks = append(chunks, products[start:min(start+size, len(products))])
+	}
+	return chunks
 }
@@ -1,6 +1,11 @@
 package datastore
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
 
 /* This package contains data types that map to the database schema */
 
@@ -17,6 +22,37 @@ type Set struct {
 	Count         int
 	ReleaseDate   string
 	ProductLineId int
+	ReleasedOn    time.Time // ReleaseDate parsed, zero if missing or in an unrecognized format
+}
+
+// Equal reports whether pl and other describe the same product line, ignoring the id assigned
+// by the database.
+func (pl Product_Line) Equal(other Product_Line) bool {
+	return pl.Name == other.Name && pl.UrlName == other.UrlName
+}
+
+// Equal reports whether s and other describe the same set with the same count and release date,
+// ignoring ids assigned by the database. Release dates are compared as parsed, so the same date
+// written in different formats is equal.
+func (s Set) Equal(other Set) bool {
+	return s.Name == other.Name &&
+		s.UrlName == other.UrlName &&
+		s.Count == other.Count &&
+		s.ReleasedOn.Equal(other.ReleasedOn)
+}
+
+// SetWithCount holds a stored set along with the number of products actually stored for it,
+// which differs from Set.Count when the set was incompletely scraped.
+type SetWithCount struct {
+	Set
+	StoredCount int
+}
+
+// SetResult holds the outcome of inserting a single set with AddSets. On success, Set holds the
+// id assigned to the set and Err is nil.
+type SetResult struct {
+	Set Set
+	Err error
 }
 
 type Product struct {
@@ -26,6 +62,7 @@ type Product struct {
 	ProductName        string          `json:"productName"`
 	ProductUrlName     string          `json:"productUrlName"`
 	CustomAttributes   json.RawMessage `json:"customAttributes"`
+	Attributes         json.RawMessage `json:"attributes"` // Common card attributes parsed from CustomAttributes
 	SetName            string          `json:"setName"`
 	SetUrlName         string          `json:"setUrlName"`
 	RarityName         string          `json:"rarityName"`
@@ -34,4 +71,38 @@ type Product struct {
 	ReleaseDate        string
 	ProductLineId      int
 	SetId              int
+	Raw                json.RawMessage `json:"-"` // Entire upstream product JSON, if captured
+	ReleasedOn         time.Time       // ReleaseDate parsed, zero if missing or in an unrecognized format
 }
+
+// String returns a compact description of the product: number, name, set, and rarity.
+func (p Product) String() string {
+	return fmt.Sprintf("#%s %s (%s, %s)", p.ProductNumber, p.ProductName, p.SetName, p.RarityName)
+}
+
+// Equal reports whether p and other describe the same product, comparing the fields that
+// identify a product and ignoring ids assigned by the TCGPlayer API or the database.
+func (p Product) Equal(other Product) bool {
+	return p.ProductName == other.ProductName &&
+		p.ProductUrlName == other.ProductUrlName &&
+		p.ProductLineUrlName == other.ProductLineUrlName &&
+		p.SetUrlName == other.SetUrlName &&
+		p.RarityName == other.RarityName &&
+		p.ProductNumber == other.ProductNumber &&
+		p.PrintEdition == other.PrintEdition
+}
+
+// ProductQuery holds optional filters for SearchProducts. Zero-valued fields are ignored.
+type ProductQuery struct {
+	ProductLineId int
+	SetId         int
+	RarityName    string
+	PrintEdition  string
+	NameContains  string // Case-insensitive substring of the product name
+	Limit         int    // Maximum number of products returned, 0 for no limit
+	Offset        int    // Number of matching products skipped
+}
+
+// ErrSetNotStored is the error of a SetResult whose set was not stored because another set in
+// the same AddSets call failed and continueOnError was not set.
+var ErrSetNotStored = errors.New("set not stored, another set in the batch failed")
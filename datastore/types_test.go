@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProductLineEqual(t *testing.T) {
+	pl := Product_Line{Id: 1, Name: "YuGiOh", UrlName: "yugioh"}
+	tests := []struct {
+		name  string
+		other Product_Line
+		want  bool
+	}{
+		{"same", pl, true},
+		{"different id", Product_Line{Id: 2, Name: "YuGiOh", UrlName: "yugioh"}, true},
+		{"different name", Product_Line{Id: 1, Name: "Yu-Gi-Oh!", UrlName: "yugioh"}, false},
+		{"different url name", Product_Line{Id: 1, Name: "YuGiOh", UrlName: "yu-gi-oh"}, false},
+	}
+	for _, tt := range tests {
+		if got := pl.Equal(tt.other); got != tt.want {
+			t.Errorf("%s: Equal() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetEqual(t *testing.T) {
+	released := time.Date(2002, time.June, 26, 0, 0, 0, 0, time.UTC)
+	set := Set{Id: 1, Name: "Metal Raiders", UrlName: "metal-raiders", Count: 144,
+		ReleaseDate: "2002-06-26T00:00:00Z", ProductLineId: 1, ReleasedOn: released}
+	with := func(modify func(*Set)) Set {
+		s := set
+		modify(&s)
+		return s
+	}
+	tests := []struct {
+		name  string
+		other Set
+		want  bool
+	}{
+		{"same", set, true},
+		{"different id", with(func(s *Set) { s.Id = 2 }), true},
+		{"different product line id", with(func(s *Set) { s.ProductLineId = 2 }), true},
+		{"release date in another format", with(func(s *Set) { s.ReleaseDate = "06/26/2002" }), true},
+		{"different name", with(func(s *Set) { s.Name = "Metal Raiders (Unlimited)" }), false},
+		{"different url name", with(func(s *Set) { s.UrlName = "metal-raiders-unlimited" }), false},
+		{"different count", with(func(s *Set) { s.Count = 145 }), false},
+		{"different release date", with(func(s *Set) { s.ReleasedOn = released.AddDate(0, 0, 1) }), false},
+		{"release date missing", with(func(s *Set) { s.ReleaseDate, s.ReleasedOn = "", time.Time{} }), false},
+	}
+	for _, tt := range tests {
+		if got := set.Equal(tt.other); got != tt.want {
+			t.Errorf("%s: Equal() = %t, want %t", tt.name, got, tt.want)
+		}
+		if got := tt.other.Equal(set); got != tt.want {
+			t.Errorf("%s: reversed Equal() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
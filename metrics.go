@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Scrape metrics shared across workers, totaled in the run summary printed at exit and
+// exposed in the Prometheus text format when the metrics server is enabled.
+var (
+	metricProductsFetched  atomic.Int64 // Products fetched from the TCGPlayer API
+	metricProductsInserted atomic.Int64 // Products written to the user data store
+	metricProductsDup      atomic.Int64 // Products dropped as duplicates of another product in the set
+	metricSetsCompleted    atomic.Int64 // Sets written to the user data store
+	metricSetsFailed       atomic.Int64 // Sets that failed to be written and were not retried
+	metricJobsFailed       atomic.Int64 // Jobs that failed to write to the user data store
+	metricJobRetries       atomic.Int64 // Failed jobs re-queued for another attempt
+	metricApiRequests      atomic.Int64 // Product page requests made to the TCGPlayer API
+	metricImagesFetched    atomic.Int64 // Product images downloaded
+	metricImagesFailed     atomic.Int64 // Product image downloads that failed
+	metricImageRetries     atomic.Int64 // Product image downloads retried after failing
+	metricSetsInFlight     atomic.Int64 // Sets fetched but not yet through the status worker
+)
+
+// metric describes a single exported metric.
+type metric struct {
+	name  string
+	help  string
+	kind  string // Prometheus metric type, counter or gauge
+	value *atomic.Int64
+}
+
+var metrics = []metric{
+	{"tcd_products_fetched_total", "Products fetched from the TCGPlayer API.", "counter", &metricProductsFetched},
+	{"tcd_products_inserted_total", "Products written to the data store.", "counter", &metricProductsInserted},
+	{"tcd_products_duplicate_total", "Products dropped as duplicates of another product in the set.", "counter", &metricProductsDup},
+	{"tcd_sets_completed_total", "Sets written to the data store.", "counter", &metricSetsCompleted},
+	{"tcd_sets_failed_total", "Sets that failed to be written to the data store and were not retried.", "counter", &metricSetsFailed},
+	{"tcd_jobs_failed_total", "Jobs that failed to write to the data store.", "counter", &metricJobsFailed},
+	{"tcd_job_retries_total", "Failed jobs re-queued for another attempt.", "counter", &metricJobRetries},
+	{"tcd_api_requests_total", "Product page requests made to the TCGPlayer API.", "counter", &metricApiRequests},
+	{"tcd_images_fetched_total", "Product images downloaded.", "counter", &metricImagesFetched},
+	{"tcd_images_failed_total", "Product image downloads that failed.", "counter", &metricImagesFailed},
+	{"tcd_image_retries_total", "Product image downloads retried after failing.", "counter", &metricImageRetries},
+	{"tcd_sets_in_flight", "Sets fetched but not yet written to the data store.", "gauge", &metricSetsInFlight},
+}
+
+// runSummary returns a block of lines totaling the work done by the run across all product lines.
+func runSummary() string {
+	return fmt.Sprintf("Run summary:\n"+
+		"  Sets processed:        %d\n"+
+		"  Products inserted:     %d\n"+
+		"  Duplicates skipped:    %d\n"+
+		"  Images downloaded:     %d\n"+
+		"  Images failed:         %d\n"+
+		"  Sets failed:           %d\n"+
+		"  Job failures:          %d\n",
+		metricSetsCompleted.Load(), metricProductsInserted.Load(), metricProductsDup.Load(),
+		metricImagesFetched.Load(), metricImagesFailed.Load(), metricSetsFailed.Load(), metricJobsFailed.Load())
+}
+
+// metricsHandler writes the current metric values in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value.Load())
+	}
+}
+
+// startMetricsServer serves metrics on addr at /metrics in the background.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error serving metrics on %s: %v", addr, err)
+		}
+	}()
+}
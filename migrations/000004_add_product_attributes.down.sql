@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS products_attributes_idx;
+ALTER TABLE products DROP COLUMN IF EXISTS attributes;
\ No newline at end of file
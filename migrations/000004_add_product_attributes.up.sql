@@ -0,0 +1,2 @@
+ALTER TABLE products ADD COLUMN attributes JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX products_attributes_idx ON products USING GIN (attributes);
\ No newline at end of file
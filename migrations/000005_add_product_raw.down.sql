@@ -0,0 +1 @@
+ALTER TABLE products DROP COLUMN IF EXISTS raw_product;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE products ADD COLUMN raw_product JSONB;
\ No newline at end of file
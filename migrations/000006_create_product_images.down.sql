@@ -0,0 +1 @@
+DROP TABLE IF EXISTS product_images;
\ No newline at end of file
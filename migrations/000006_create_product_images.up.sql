@@ -0,0 +1,6 @@
+CREATE TABLE  product_images (
+    product_id INT NOT NULL,
+    image_data BYTEA NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (product_id)
+);
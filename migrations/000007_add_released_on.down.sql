@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS sets_released_on_idx;
+ALTER TABLE products DROP COLUMN IF EXISTS released_on;
+ALTER TABLE sets DROP COLUMN IF EXISTS released_on;
@@ -0,0 +1,3 @@
+ALTER TABLE sets ADD COLUMN released_on TIMESTAMPTZ;
+ALTER TABLE products ADD COLUMN released_on TIMESTAMPTZ;
+CREATE INDEX sets_released_on_idx ON sets (product_line_id, released_on);
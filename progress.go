@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gurbos/tcd/tcapi"
+)
+
+const PROGRESS_INTERVAL = 5 * time.Second // Interval between periodic progress reports
+
+// Progress holds scrape counters shared across workers. Counters are updated
+// atomically so workers never block on the reporter.
+type Progress struct {
+	setsTotal        atomic.Int64
+	setsCompleted    atomic.Int64
+	productsInserted atomic.Int64
+	setsNotProcessed atomic.Int64 // Sets dropped from the pipeline after cancellation
+	setsEmpty        atomic.Int64 // Sets skipped because no products were found
+	imagesNotFetched atomic.Int64 // Sets whose images were not fetched after cancellation
+	apiCalls         atomic.Int64 // Product page fetches made
+	apiCallsExpected atomic.Int64 // Minimum product page fetches needed
+	setsOverFetched  atomic.Int64 // Sets that needed more page fetches than expected
+	failedImagesMu   sync.Mutex   // Guards failedImages
+	failedImages     []int        // TCGPlayer product Ids whose image could not be fetched
+	failedSetsMu     sync.Mutex   // Guards failedSets
+	failedSets       []string     // Sets that failed to be written, each followed by its error
+	done             chan struct{}
+	wg               sync.WaitGroup
+}
+
+// NewProgress creates a Progress tracker for the specified number of sets.
+func NewProgress(setsTotal int) *Progress {
+	p := &Progress{done: make(chan struct{})}
+	p.setsTotal.Store(int64(setsTotal))
+	return p
+}
+
+// SetCompleted records a successfully processed set and the number of products inserted for it.
+func (p *Progress) SetCompleted(productCount int) {
+	p.setsCompleted.Add(1)
+	p.productsInserted.Add(int64(productCount))
+}
+
+// SetEmpty records a set skipped because no products were found for it. It counts as completed,
+// since there is nothing left to do for it.
+func (p *Progress) SetEmpty() {
+	p.setsCompleted.Add(1)
+	p.setsEmpty.Add(1)
+}
+
+// SetNotProcessed records a set that was drained from the pipeline without being processed.
+func (p *Progress) SetNotProcessed() {
+	p.setsNotProcessed.Add(1)
+}
+
+// SetFailed records a set that could not be written to the data store and won't be retried.
+func (p *Progress) SetFailed(setName string, err error) {
+	p.failedSetsMu.Lock()
+	defer p.failedSetsMu.Unlock()
+	p.failedSets = append(p.failedSets, fmt.Sprintf("%s: %v", setName, err))
+}
+
+// FailedSets returns the sets that could not be written, each followed by its error, in the
+// order they failed.
+func (p *Progress) FailedSets() []string {
+	p.failedSetsMu.Lock()
+	defer p.failedSetsMu.Unlock()
+	return slices.Clone(p.failedSets)
+}
+
+// ImagesNotFetched records a set whose images were drained from the pipeline without being fetched.
+func (p *Progress) ImagesNotFetched() {
+	p.imagesNotFetched.Add(1)
+}
+
+// ImagesFailed records the TCGPlayer product Ids whose image could not be fetched after all attempts.
+func (p *Progress) ImagesFailed(productIds []int) {
+	if len(productIds) == 0 {
+		return
+	}
+	p.failedImagesMu.Lock()
+	defer p.failedImagesMu.Unlock()
+	p.failedImages = append(p.failedImages, productIds...)
+}
+
+// FailedImages returns the sorted TCGPlayer product Ids whose image could not be fetched.
+func (p *Progress) FailedImages() []int {
+	p.failedImagesMu.Lock()
+	defer p.failedImagesMu.Unlock()
+	failed := slices.Clone(p.failedImages)
+	slices.Sort(failed)
+	return failed
+}
+
+// ApiCalls records the page fetches made for a set.
+func (p *Progress) ApiCalls(stats tcapi.FetchStats) {
+	p.apiCalls.Add(int64(stats.Calls))
+	p.apiCallsExpected.Add(int64(stats.ExpectedCalls))
+	if stats.Exceeded() {
+		p.setsOverFetched.Add(1)
+	}
+}
+
+// Summary returns a single line describing the current progress.
+func (p *Progress) Summary() string {
+	total := p.setsTotal.Load()
+	completed := p.setsCompleted.Load()
+	var pct float64
+	if total > 0 {
+		pct = float64(completed) / float64(total) * 100
+	}
+	summary := fmt.Sprintf("Progress: %d/%d sets (%.1f%%), %d products inserted",
+		completed, total, pct, p.productsInserted.Load())
+	summary += fmt.Sprintf(", %d API calls (%d expected)", p.apiCalls.Load(), p.apiCallsExpected.Load())
+	if overFetched := p.setsOverFetched.Load(); overFetched > 0 {
+		summary += fmt.Sprintf(", %d sets over-fetched", overFetched)
+	}
+	if empty := p.setsEmpty.Load(); empty > 0 {
+		summary += fmt.Sprintf(", %d sets empty", empty)
+	}
+	if failed := len(p.FailedSets()); failed > 0 {
+		summary += fmt.Sprintf(", %d sets failed", failed)
+	}
+	if notProcessed, notFetched := p.setsNotProcessed.Load(), p.imagesNotFetched.Load(); notProcessed+notFetched > 0 {
+		summary += fmt.Sprintf(", %d sets not processed, %d sets without images", notProcessed, notFetched)
+	}
+	return summary
+}
+
+// Start launches the progress reporter goroutine, which writes a summary to w
+// every interval until Stop is called.
+func (p *Progress) Start(w io.Writer, interval time.Duration) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintln(w, p.Summary())
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop signals the progress reporter to exit and waits for it to finish.
+// Stop is a no-op if the reporter was never started.
+func (p *Progress) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
@@ -4,53 +4,130 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg" // Register JPEG decoder for image validation
+	_ "image/png"  // Register PNG decoder for image validation
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gurbos/tcd/datastore"
 )
 
 // Fetch product line data from TCGPlayer API.
-// Search parameters are specified in sParams.
-func FetchProductLineData(sParams SearchParams) (results SearchResults) {
-	client := http.Client{Timeout: 60 * time.Second}
-	reqBody := NewSearchFilter(sParams)                           // Create search criteria in io.Reader format
-	req := InitRequest(http.MethodPost, DATA_SEARCH_URL, reqBody) // Create HTTP request with search criteria
-	res, err := client.Do(req)                                    // Execute HTTP request
+// Search parameters are specified in sParams. If the client has a cache enabled,
+// a cached response within the cache TTL is returned without calling the API.
+func (c *Client) FetchProductLineData(sParams SearchParams) (results SearchResults) {
+	results, err := c.search(context.Background(), sParams)
 	if err != nil {
-		log.Fatal(
-			fmt.Errorf("Error fetching product line data from TCGPlayer API: %w", err),
-		)
+		log.Fatal(err)
+	}
+	return results
+}
+
+// search executes a search request for sParams, returning the decoded response.
+func (c *Client) search(ctx context.Context, sParams SearchParams) (results SearchResults, err error) {
+	var key string
+	if c.cache != nil {
+		key = cacheKey(c.Config.BaseSearchURL, sParams)
+		if data, ok := c.cache.get(key); ok && json.Unmarshal(data, &results) == nil {
+			return results, nil
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, c.SearchTimeout)
+	defer cancel()
+
+	reqBody := NewSearchFilter(sParams)                                  // Create search criteria in io.Reader format
+	req := InitRequest(http.MethodPost, c.Config.BaseSearchURL, reqBody) // Create HTTP request with search criteria
+	c.mergeHeaders(req)                                                  // Apply the client's header overrides
+	res, err := c.searchClient.Do(req.WithContext(ctx))                  // Execute HTTP request
+	if err != nil {
+		return results, fmt.Errorf("Error fetching product line data from TCGPlayer API: %w", err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return results, fmt.Errorf("Error fetching product line data from TCGPlayer API: %w %s", ErrUnexpectedStatus, res.Status)
+	}
 
-	var resData bytes.Buffer                  // buffer to hold raw json response data
-	resData.ReadFrom(res.Body)                // Read response body into buffer
-	json.Unmarshal(resData.Bytes(), &results) // Unmarshal JSON data into SearchResults struct
-	return results
+	resData, err := readLimited(res.Body, c.MaxSearchResponseSize) // Read response body, up to the size limit
+	if err != nil {
+		return results, fmt.Errorf("Error reading product line data from TCGPlayer API: %w", err)
+	}
+	// Unmarshal JSON data into SearchResults struct, failing loudly if an OK response no longer
+	// has the expected shape
+	err = json.Unmarshal(resData, &results)
+	if err := checkSearchResults(sParams, results, err); err != nil {
+		return results, err
+	}
+
+	// Cache successful responses only, so errors are retried on the next request. Pages that
+	// came back empty aren't cached either, so FetchProductsInParts can retry them.
+	emptyPage := sParams.Size > 0 && (len(results.Results) == 0 || len(results.Results[0].Results) == 0)
+	if c.cache != nil && !emptyPage {
+		if err := c.cache.put(key, resData); err != nil {
+			log.Printf("Error caching search response: %v", err)
+		}
+	}
+	return results, nil
 }
 
-// Return list of card sets for the specified product linefrom TCGPlayer API
-func FetchSetsByProductLine(productLine string) []datastore.Set {
-	sParams := NewSearchParams("", "", "", 0, 0)
-	sParams.ProductLine = productLine
-	respData := FetchProductLineData(sParams)
+// Return the total number of products matching sParams from TCGPlayer API without fetching
+// any products, by issuing a single size 0 search and reading the result total.
+func (c *Client) FetchProductCount(ctx context.Context, sParams SearchParams) (int, error) {
+	sParams.From, sParams.Size = 0, 0
+	results, err := c.search(ctx, sParams)
+	if err != nil {
+		return 0, err
+	}
+	if len(results.Results) == 0 {
+		return 0, fmt.Errorf("Error fetching product count: empty search results")
+	}
+	return results.Results[0].TotalResults, nil
+}
+
+// Return list of card sets for the specified product line from TCGPlayer API. productLine is
+// the product line url name, as for SearchParams.ProductLine.
+// If productType is not empty, set counts only include products of that type.
+func (c *Client) FetchSetsByProductLine(productLine string, productType string) []datastore.Set {
+	sParams := NewSearchParams(productLine, "", productType, 0, 0)
+	respData := c.FetchProductLineData(sParams)
 	return toSets(respData.Results[0].Aggregations.SetName)
 }
 
 // Return list of all product lines from TCGPlayer API
-func FetchProductLines() []ValueType {
+func (c *Client) FetchProductLines() []ValueType {
 	sParams := NewSearchParams("", "", "", 0, 0)
-	respData := FetchProductLineData(sParams)
+	respData := c.FetchProductLineData(sParams)
 	return respData.Results[0].Aggregations.ProductLineName
 }
 
-func FetchProductLineByName(urlName string) *datastore.Product_Line {
-	pl := FetchProductLines()
+// Return the card type, rarity, and product type aggregations of the specified product line
+// (url name) from TCGPlayer API, listing the values accepted by the corresponding filters.
+func (c *Client) FetchAggregations(productLine string) ProductLineAggregations {
+	sParams := NewSearchParams(productLine, "", "", 0, 0)
+	aggs := c.FetchProductLineData(sParams).Results[0].Aggregations
+	return ProductLineAggregations{
+		CardTypes:    aggs.CardType,
+		Rarities:     aggs.RarityName,
+		ProductTypes: aggs.ProductTypeName,
+	}
+}
+
+// Return the product line whose url name or display name matches name from TCGPlayer API, or nil
+// if none matches. Names are compared case-insensitively, so "yugioh" and "Yu-Gi-Oh!" both match.
+func (c *Client) FetchProductLineByName(name string) *datastore.Product_Line {
+	pl := c.FetchProductLines()
 	for _, elem := range pl {
-		if elem.UrlName == urlName {
+		if strings.EqualFold(elem.UrlName, name) || strings.EqualFold(elem.Name, name) {
 			return &datastore.Product_Line{
 				Id:      0,
 				Name:    elem.Name,
@@ -63,64 +140,419 @@ func FetchProductLineByName(urlName string) *datastore.Product_Line {
 }
 
 // Return just the search results from the response data from TCGPlayer API
-func FetchProducts(sParams SearchParams) []datastore.Product {
-	respData := FetchProductLineData(sParams)
+func (c *Client) FetchProducts(sParams SearchParams) []datastore.Product {
+	respData := c.FetchProductLineData(sParams)
 	return toProducts(respData.Results[0].Results)
 }
 
+// Return a page of products matching sParams, and the total number of matching products across
+// all pages, from TCGPlayer API. The total is -1 if the response doesn't include one.
+func (c *Client) fetchPage(ctx context.Context, sParams SearchParams) ([]datastore.Product, int, error) {
+	respData, err := c.search(ctx, sParams)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(respData.Results) == 0 {
+		return nil, -1, nil
+	}
+	total := respData.Results[0].TotalResults
+	if !respData.Results[0].hasTotal {
+		total = -1
+	}
+	return toProducts(respData.Results[0].Results), total, nil
+}
+
+// Return the release date of the earliest released product of the set from TCGPlayer API, with a
+// single size 1 search sorted by release date, and whether a release date was found.
+func (c *Client) FetchSetReleaseDate(productLine string, setName string, productType string) (time.Time, bool) {
+	sParams := NewSearchParams(productLine, setName, productType, 0, 1)
+	sParams.Sort = "release-date-asc"
+	products, _, err := c.fetchPage(context.Background(), sParams)
+	if err != nil {
+		log.Printf("Error fetching release date of set '%s': %v", setName, err)
+		return time.Time{}, false
+	}
+	extractProductAttributes(products)
+	if len(products) == 0 || products[0].ReleasedOn.IsZero() {
+		return time.Time{}, false
+	}
+	return products[0].ReleasedOn, true
+}
+
 // The TCGPlayer API limits the maximum number of results returned in a single response.
-// This function fetches results in chunks of that maximum; it repeatedly calls
-// FetchProducts until the total size specified in sParams.Size is reached.
-func FetchProductsInParts(sParams SearchParams) []datastore.Product {
+// This function fetches results in chunks of that maximum, repeatedly fetching pages until
+// the total size is reached. The returned FetchStats records how many API calls were made.
+//
+// sParams.Size is only the initial size: the totalResults of the first page is authoritative,
+// since a set's aggregation count may be stale, and sParams.Size is kept only if the response
+// has no total. Fetching starts at offset sParams.From, so a partially fetched result set can
+// be resumed; the products at offsets From up to the size are returned. Offsets are only
+// meaningful across searches if sParams.Sort gives a stable order.
+//
+// A page that fails transiently, with an unexpected status or a network error, or comes back
+// empty without a total or with fewer products than the total says it should hold, is retried up
+// to EMPTY_PAGE_ATTEMPTS times. A page that can't be fetched, such as one whose response is too
+// large or no longer has the expected shape, or that still fails after retrying, stops the fetch:
+// the products fetched before it are returned, with the error in FetchStats.Err, so the caller can
+// fail just this result set. Canceling ctx stops the fetch the same way, without waiting out a retry.
+//
+// When the total matches sParams.Size, exactly ExpectedPageCount(size - from) calls are made, the last
+// one requesting only the remainder: sizes 0, 1, 49, 50, 51, 100, and 101 make 0, 1, 1, 1, 2, 2, and 3
+// calls respectively.
+func (c *Client) FetchProductsInParts(ctx context.Context, sParams SearchParams) ([]datastore.Product, FetchStats) {
 	var allResults []datastore.Product
 	size := sParams.Size
+	start := max(sParams.From, 0)
+	stats := FetchStats{ExpectedCalls: ExpectedPageCount(size - start)}
+	if size-start <= 0 {
+		return allResults, stats
+	}
 
-	sParams.Size = MAX_RESULT_SIZE
-	for from := 0; from < size; from += MAX_RESULT_SIZE {
+	// Advance by the size requested, not MAX_RESULT_SIZE, since the first page may have requested
+	// less than a full page before the total raised the size
+	for from := start; from < size; from += sParams.Size {
 		sParams.From = from
-		if from+MAX_RESULT_SIZE > size {
-			sParams.Size = size - from
+		sParams.Size = min(MAX_RESULT_SIZE, size-from)
+		res, total, err := c.fetchPage(ctx, sParams)
+		stats.Calls++
+
+		// Retry a page that failed transiently or is unexpectedly empty, as both are usually transient
+		// API errors. A total of 0 means the set is empty, so isn't retried.
+		for attempt := 2; retryPage(ctx, res, total, from, err) && attempt <= EMPTY_PAGE_ATTEMPTS; attempt++ {
+			if err != nil {
+				log.Printf("Error fetching page at offset %d of set '%s', retrying (attempt %d of %d): %v",
+					from, sParams.SetName, attempt, EMPTY_PAGE_ATTEMPTS, err)
+			} else {
+				log.Printf("Empty page at offset %d of set '%s', retrying (attempt %d of %d)",
+					from, sParams.SetName, attempt, EMPTY_PAGE_ATTEMPTS)
+			}
+			select {
+			case <-time.After(EMPTY_PAGE_RETRY_DELAY):
+				res, total, err = c.fetchPage(ctx, sParams)
+				stats.Calls++
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			stats.Err = fmt.Errorf("Error fetching page at offset %d of set '%s': %w", from, sParams.SetName, err)
+			break
+		}
+		if len(res) == 0 && (total < 0 || total > from) {
+			log.Printf("Empty page at offset %d of set '%s' after %d attempts, up to %d products missed",
+				from, sParams.SetName, EMPTY_PAGE_ATTEMPTS, sParams.Size)
 		}
-		res := FetchProducts(sParams)
 		allResults = append(allResults, res...)
+
+		// Use the first page's total as the size, so products beyond a stale count aren't missed
+		if from == start && total > 0 && total != size {
+			size = total
+			stats.ExpectedCalls = ExpectedPageCount(size - start)
+		}
+	}
+
+	unparsed := extractProductAttributes(allResults) // Populate product info from raw JSON data
+	stats.SchemaErr = checkProductAttributes(len(allResults), unparsed)
+	return allResults, stats
+}
+
+// ExpectedPageCount returns the minimum number of API calls needed to fetch size products.
+func ExpectedPageCount(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	return (size + MAX_RESULT_SIZE - 1) / MAX_RESULT_SIZE
+}
+
+// ErrProductNotFound is returned by FetchProductById when the TCGPlayer API has no product
+// with the requested Id.
+var ErrProductNotFound = errors.New("product not found")
+
+// Fetch a single product's details from TCGPlayer API by product Id, including its
+// custom attributes.
+func (c *Client) FetchProductById(ctx context.Context, productId int) (datastore.Product, error) {
+	ctx, cancel := withTimeout(ctx, c.SearchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(c.Config.ProductDetailsURL, productId), nil)
+	if err != nil {
+		return datastore.Product{}, fmt.Errorf("Error creating HTTP request for product %d: %w", productId, err)
 	}
+	InitRequestHeader(req)
+	c.mergeHeaders(req)
 
-	extractProductAttributes(allResults) // Populate product info from raw JSON data
-	return allResults
+	res, err := c.searchClient.Do(req)
+	if err != nil {
+		return datastore.Product{}, fmt.Errorf("Error fetching product %d from TCGPlayer API: %w", productId, err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return datastore.Product{}, fmt.Errorf("Error fetching product %d: %w", productId, ErrProductNotFound)
+	case res.StatusCode != http.StatusOK:
+		return datastore.Product{}, fmt.Errorf("Error fetching product %d: unexpected status %s", productId, res.Status)
+	}
+
+	var product Product
+	if err := json.NewDecoder(io.LimitReader(res.Body, c.MaxSearchResponseSize)).Decode(&product); err != nil {
+		return datastore.Product{}, fmt.Errorf("Error decoding product %d: %w", productId, err)
+	}
+	if id, err := ParseProductId(product.ProductId); err != nil || id == 0 {
+		return datastore.Product{}, fmt.Errorf("Error fetching product %d: %w", productId, ErrProductNotFound)
+	}
+
+	products := toProducts([]Product{product})
+	extractProductAttributes(products) // Populate product info from raw JSON data
+	return products[0], nil
 }
 
-// Fetch product image from TCGPlayer API by product Id.
-func FetchProductImageById(ctx context.Context, imageId int) ([]byte, error) {
-	client := http.Client{Timeout: 60 * time.Second}
+// fetchProductImage fetches a product image, in the size and format specified by spec, using
+// the client's image HTTP client and base image URL.
+func (c *Client) fetchProductImage(ctx context.Context, imageId int, spec ImageSpec) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, c.ImageTimeout)
+	defer cancel()
 
-	imageUrl := fmt.Sprintf("%s%d_in_%s", BASE_IMAGE_URL, imageId, IMAGE_FORMAT_SUFFIX)
-	req, err := http.NewRequest(http.MethodGet, imageUrl, nil)
+	imageUrl := fmt.Sprintf("%s%d_%s", c.Config.BaseImageURL, imageId, spec.Suffix())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageUrl, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating HTTP request for product image: %w", err)
 	}
+	c.mergeHeaders(req) // Image requests carry no default headers, only the client's overrides
 
-	res, err := client.Do(req)
+	res, err := c.imageClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Error fetching product image from TCGPlayer API: %w", err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching product image %d: unexpected status %s", imageId, res.Status)
+	}
 
-	var imgData bytes.Buffer
-	imgData.ReadFrom(res.Body)
-	return imgData.Bytes(), nil
+	imgData, err := readLimited(res.Body, c.MaxImageResponseSize)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading product image %d: %w", imageId, err)
+	}
+	if err := ValidateImage(imgData); err != nil {
+		return nil, fmt.Errorf("Error validating product image %d: %w", imageId, err)
+	}
+	return imgData, nil
+}
+
+// retryPage returns whether a page fetched at offset from, with products res, the total and the
+// error fetching it, should be fetched again: the fetch failed transiently, or the page is empty
+// but the total, or the lack of one, says it should hold products. Pages too large or no longer
+// of the expected shape fail the same way when fetched again, so aren't retried, and nothing is
+// retried once ctx is canceled.
+func retryPage(ctx context.Context, res []datastore.Product, total int, from int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, ErrSchemaChange) && !errors.Is(err, ErrResponseTooLarge)
+	}
+	return len(res) == 0 && (total < 0 || total > from)
+}
+
+// ErrUnexpectedStatus is wrapped by errors returned when TCGPlayer API responds to a search with
+// a status other than OK, such as a 503 from an overloaded server.
+var ErrUnexpectedStatus = errors.New("unexpected status")
+
+// ErrSchemaChange is wrapped by errors returned when a TCGPlayer API response is missing data it
+// should hold, which usually means the API renamed or restructured the fields read by tcapi.
+var ErrSchemaChange = errors.New("possible TCGPlayer API schema change")
+
+// checkSearchResults returns an error wrapping ErrSchemaChange if the results of an OK search
+// response don't have the expected shape: decodeErr is the error decoding the response, the
+// results array is missing, or a size 0 search, which is made for its aggregations, matched
+// products but returned no aggregation values.
+func checkSearchResults(sParams SearchParams, results SearchResults, decodeErr error) error {
+	if decodeErr != nil {
+		return fmt.Errorf("Error decoding search response: %w: %w", ErrSchemaChange, decodeErr)
+	}
+	if len(results.Results) == 0 {
+		return fmt.Errorf("Search response has no results: %w", ErrSchemaChange)
+	}
+	aggs := results.Results[0].Aggregations
+	noAggregations := len(aggs.CardType) == 0 && len(aggs.RarityName) == 0 && len(aggs.SetName) == 0 &&
+		len(aggs.ProductTypeName) == 0 && len(aggs.ProductLineName) == 0 && len(aggs.Condition) == 0
+	if sParams.Size == 0 && results.Results[0].TotalResults > 0 && noAggregations {
+		return fmt.Errorf("Search response matched %d products but has no aggregations: %w",
+			results.Results[0].TotalResults, ErrSchemaChange)
+	}
+	return nil
+}
+
+// checkProductAttributes returns an error wrapping ErrSchemaChange if the custom attributes of
+// most of the products, unparsed of them, couldn't be parsed. Fetches of fewer than
+// SCHEMA_CHECK_MIN_PRODUCTS products are too small to judge and always pass.
+func checkProductAttributes(products int, unparsed int) error {
+	if products < SCHEMA_CHECK_MIN_PRODUCTS || unparsed*2 <= products {
+		return nil
+	}
+	return fmt.Errorf("Custom attributes of %d of %d products could not be parsed: %w", unparsed, products, ErrSchemaChange)
+}
+
+// ErrResponseTooLarge is returned when a response body exceeds the client's size limit.
+var ErrResponseTooLarge = errors.New("response exceeds size limit")
+
+// readLimited reads r to the end, returning ErrResponseTooLarge if it holds more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, limit)
+	}
+	return data, nil
+}
+
+// ValidateImage checks that data holds a complete image in a supported format, rejecting
+// error pages and truncated downloads served in place of an image.
+func ValidateImage(data []byte) error {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid image data (%d bytes): %w", len(data), err)
+	}
+	// A complete JPEG ends with the end of image marker
+	if format == "jpeg" && !bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xFF, 0xD9}) {
+		return fmt.Errorf("truncated jpeg image (%d bytes)", len(data))
+	}
+	return nil
 }
 
 // Extract custom product attributes from JSON raw message and populate Product struct fields.
 // Used to populate 'Number' and 'ReleaseDate' fields in Product struct from raw JSON data in
-// 'CustomAttributes' field.
-func extractProductAttributes(products []datastore.Product) {
-	var attrs customAttrs
+// 'CustomAttributes' field, using the attribute key names registered for the product's
+// product line, and the 'Attributes' field with the common card attributes listed in
+// cardAttributeKeys. Products whose custom attributes are not a JSON object (null, array,
+// or scalar) are skipped, leaving the raw value untouched. Returns the number of products
+// skipped.
+func extractProductAttributes(products []datastore.Product) (unparsed int) {
 	for i := 0; i < len(products); i++ {
 		elem := &products[i]
-		json.Unmarshal(elem.CustomAttributes, &attrs)
-		elem.ProductNumber = attrs.Number
-		elem.ReleaseDate = attrs.ReleaseDate
+		elem.Attributes = json.RawMessage("{}")
+		if !isJSONObject(elem.CustomAttributes) {
+			unparsed++
+			continue
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(elem.CustomAttributes, &raw); err != nil {
+			unparsed++
+			continue
+		}
+		keys := attributeKeysFor(elem.ProductLineUrlName)
+		elem.ProductNumber = SanitizeProductNumber(firstAttributeValue(raw, keys.Number))
+		elem.ReleaseDate = firstAttributeValue(raw, keys.ReleaseDate)
+		elem.ReleasedOn, _ = ParseReleaseDate(elem.ReleaseDate)
+		elem.Attributes = extractCardAttributes(raw)
 	}
+	return unparsed
+}
+
+// SanitizeProductNumber returns the product number with surrounding whitespace trimmed, or an
+// empty string, so the product is dropped as having no number, if the number can't be stored:
+// it holds a control character such as a null byte, which Postgres rejects in text, or is longer
+// than MAX_PRODUCT_NUMBER_LEN characters. Slashes are kept since product numbers such as "4/102"
+// use them; callers building file paths from a product number must still escape it.
+func SanitizeProductNumber(number string) string {
+	number = strings.TrimSpace(number)
+	if strings.ContainsFunc(number, unicode.IsControl) || utf8.RuneCountInString(number) > MAX_PRODUCT_NUMBER_LEN {
+		return ""
+	}
+	return number
+}
+
+// firstAttributeValue returns the value of the first key in keys that holds a non-empty
+// string or number in the raw custom attributes, or an empty string if none do.
+func firstAttributeValue(raw map[string]json.RawMessage, keys []string) string {
+	for _, key := range keys {
+		val, ok := raw[key]
+		if !ok {
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(val, &str); err == nil && str != "" {
+			return str
+		}
+		var num json.Number
+		if err := json.Unmarshal(val, &num); err == nil {
+			return num.String()
+		}
+	}
+	return ""
+}
+
+// extractCardAttributes returns a JSON object holding the keys in cardAttributeKeys that are
+// present in the raw custom attributes.
+func extractCardAttributes(raw map[string]json.RawMessage) json.RawMessage {
+	attrs := make(map[string]json.RawMessage)
+	for _, key := range cardAttributeKeys {
+		if val, ok := raw[key]; ok && string(val) != "null" {
+			attrs[key] = val
+		}
+	}
+	res, err := json.Marshal(attrs)
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return res
+}
+
+// ValidateCustomAttributes checks that raw custom attributes stored for a product of the
+// specified product line are a JSON object holding the product number and release date keys
+// registered for that product line. It returns an error describing the first problem found.
+func ValidateCustomAttributes(productLineUrlName string, data json.RawMessage) error {
+	if !isJSONObject(data) {
+		return fmt.Errorf("custom attributes are not a JSON object")
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("custom attributes failed to parse: %w", err)
+	}
+	keys := attributeKeysFor(productLineUrlName)
+	if firstAttributeValue(raw, keys.Number) == "" {
+		return fmt.Errorf("custom attributes missing number (keys %v)", keys.Number)
+	}
+	if firstAttributeValue(raw, keys.ReleaseDate) == "" {
+		return fmt.Errorf("custom attributes missing release date (keys %v)", keys.ReleaseDate)
+	}
+	return nil
+}
+
+// isJSONObject reports whether the raw JSON data is a JSON object.
+func isJSONObject(data json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// nowFunc returns the current time. Cache expiry calls nowFunc rather than time.Now so tests can
+// substitute a fixed clock.
+var nowFunc = time.Now
+
+// Release date formats used by the TCGPlayer API, tried in order
+var releaseDateFormats = []string{
+	time.RFC3339,          // 2002-03-08T00:00:00Z
+	"2006-01-02T15:04:05", // 2002-03-08T00:00:00
+	time.DateOnly,         // 2002-03-08
+	"01/02/2006",          // 03/08/2002
+	"1/2/2006",            // 3/8/2002
+}
+
+// Parse a TCGPlayer release date in any of the formats the API uses. Returns false if date is
+// empty or in an unrecognized format.
+func ParseReleaseDate(date string) (time.Time, bool) {
+	date = strings.TrimSpace(date)
+	if date == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range releaseDateFormats {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
 }
 
 // ToSets converts a slice of data.ValueType to a slice of datastore.Set
@@ -134,18 +566,42 @@ func toSets(setsData []ValueType) (sets []datastore.Set) {
 	return sets
 }
 
+// Return the product id held by the JSON number n. Ids written in floating point form, such as
+// 12345.0, are accepted only if they are whole numbers small enough to be represented exactly,
+// so a rounded id never reaches the database or an image URL.
+func ParseProductId(n json.Number) (int, error) {
+	if id, err := strconv.ParseInt(n.String(), 10, 0); err == nil {
+		return int(id), nil
+	}
+	f, err := n.Float64()
+	if err != nil || f != math.Trunc(f) || math.Abs(f) >= 1<<53 { // 2^53 + 1 rounds to 2^53, so 2^53 may be rounded too
+		return 0, fmt.Errorf("invalid product id '%s', expected an integer", n)
+	}
+	return int(f), nil
+}
+
+// Return the products converted to datastore products. Products with an invalid id are
+// logged and dropped.
 func toProducts(products []Product) []datastore.Product {
-	dsp := make([]datastore.Product, len(products))
-	for i, elem := range products {
-		dsp[i].ProductId = int(elem.ProductId)
-		dsp[i].ProductLineName = elem.ProductLineName
-		dsp[i].ProductLineUrlName = elem.ProductLineUrlName
-		dsp[i].ProductName = elem.ProductName
-		dsp[i].ProductUrlName = elem.ProductUrlName
-		dsp[i].CustomAttributes = elem.CustomAttributes
-		dsp[i].SetName = elem.SetName
-		dsp[i].SetUrlName = elem.SetUrlName
-		dsp[i].RarityName = elem.RarityName
+	dsp := make([]datastore.Product, 0, len(products))
+	for _, elem := range products {
+		id, err := ParseProductId(elem.ProductId)
+		if err != nil {
+			log.Printf("Skipping product '%s' of set '%s': %v", elem.ProductName, elem.SetName, err)
+			continue
+		}
+		dsp = append(dsp, datastore.Product{
+			ProductId:          id,
+			ProductLineName:    elem.ProductLineName,
+			ProductLineUrlName: elem.ProductLineUrlName,
+			ProductName:        elem.ProductName,
+			ProductUrlName:     elem.ProductUrlName,
+			CustomAttributes:   elem.CustomAttributes,
+			SetName:            elem.SetName,
+			SetUrlName:         elem.SetUrlName,
+			RarityName:         elem.RarityName,
+			Raw:                elem.Raw,
+		})
 	}
 	return dsp
 }
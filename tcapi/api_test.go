@@ -0,0 +1,359 @@
+package tcapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gurbos/tcd/datastore"
+)
+
+func TestFetchProductsInPartsCalls(t *testing.T) {
+	tests := []struct {
+		size  int
+		calls int
+	}{
+		{0, 0},
+		{1, 1},
+		{49, 1},
+		{50, 1},
+		{51, 2},
+		{100, 2},
+		{101, 3},
+	}
+	for _, tt := range tests {
+		c, api := newStubClient(t, tt.size)
+		products, stats := c.FetchProductsInParts(context.Background(), NewSearchParams("yugioh", "metal-raiders", "", 0, tt.size))
+		if n := len(api.Searches()); n != tt.calls || stats.Calls != tt.calls {
+			t.Errorf("size %d: %d requests sent, %d calls counted, want %d", tt.size, n, stats.Calls, tt.calls)
+		}
+		if want := ExpectedPageCount(tt.size); stats.ExpectedCalls != want || tt.calls != want || stats.Exceeded() {
+			t.Errorf("size %d: %+v, want %d expected calls", tt.size, stats, want)
+		}
+		if len(products) != tt.size {
+			t.Errorf("size %d: %d products returned", tt.size, len(products))
+		}
+	}
+}
+
+func TestFetchProductsInPartsEmptyPages(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      int
+		emptyPages int
+		calls      int
+	}{
+		{"empty set", 0, 0, 1}, // Not retried, total says there are no products
+		{"transient empty page", 3, 1, 2},
+	}
+	for _, tt := range tests {
+		c, api := newStubClient(t, tt.total)
+		api.emptyPages = tt.emptyPages
+		products, stats := c.FetchProductsInParts(context.Background(), NewSearchParams("yugioh", "spell-ruler", "", 0, 3))
+		if stats.Calls != tt.calls || len(products) != tt.total {
+			t.Errorf("%s: %d products after %d calls, want %d after %d", tt.name, len(products), stats.Calls, tt.total, tt.calls)
+		}
+	}
+}
+
+func TestExtractProductAttributesNonObject(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs string
+	}{
+		{"null", `null`},
+		{"array", `[{"number": "LOB-001"}]`},
+		{"empty array", `[]`},
+		{"string", `"LOB-001"`},
+		{"number", `42`},
+		{"missing", ``},
+	}
+	for _, tt := range tests {
+		products := []datastore.Product{{CustomAttributes: json.RawMessage(tt.attrs)}}
+		unparsed := extractProductAttributes(products)
+		p := products[0]
+		if unparsed != 1 || p.ProductNumber != "" || !p.ReleasedOn.IsZero() || string(p.Attributes) != "{}" {
+			t.Errorf("%s: unparsed %d, product %+v, want the product skipped", tt.name, unparsed, p)
+		}
+		if string(p.CustomAttributes) != tt.attrs {
+			t.Errorf("%s: custom attributes = %s, want the raw value %s kept", tt.name, p.CustomAttributes, tt.attrs)
+		}
+	}
+}
+
+func TestExtractProductAttributes(t *testing.T) {
+	tests := []struct {
+		name        string
+		productLine string
+		attrs       string
+		number      string
+		releaseDate string
+		attributes  map[string]any // Expected queryable attributes
+	}{
+		{"yugioh", "yugioh", `{
+			"number": "LOB-001", "releaseDate": "2002-03-08T00:00:00Z", "rarityDbName": "UR",
+			"description": "This legendary dragon is a powerful engine of destruction.",
+			"cardType": ["Monster"], "attribute": ["Light"], "monsterType": ["Dragon", "Normal"],
+			"attack": "3000", "defense": "2500", "level": "8", "linkRating": null}`,
+			"LOB-001", "2002-03-08T00:00:00Z", map[string]any{
+				"description": "This legendary dragon is a powerful engine of destruction.",
+				"cardType":    []any{"Monster"}, "attribute": []any{"Light"}, "monsterType": []any{"Dragon", "Normal"},
+				"attack": "3000", "defense": "2500", "level": "8",
+			}},
+		{"magic", "magic", `{
+			"collectorNumber": 161, "releaseDate": "08/05/1993", "flavorText": null,
+			"color": ["Black"], "convertedCost": 1, "power": null, "toughness": null,
+			"subTypes": "", "description": "Destroy target nonartifact, nonblack creature."}`,
+			"161", "08/05/1993", map[string]any{
+				"color": []any{"Black"}, "convertedCost": 1.0, "subTypes": "",
+				"description": "Destroy target nonartifact, nonblack creature.",
+			}},
+	}
+	for _, tt := range tests {
+		products := []datastore.Product{{ProductLineUrlName: tt.productLine, CustomAttributes: json.RawMessage(tt.attrs)}}
+		if unparsed := extractProductAttributes(products); unparsed != 0 {
+			t.Errorf("%s: %d products unparsed", tt.name, unparsed)
+		}
+		p := products[0]
+		if p.ProductNumber != tt.number || p.ReleaseDate != tt.releaseDate || p.ReleasedOn.IsZero() {
+			t.Errorf("%s: number %q, release date %q (%v), want %q, %q", tt.name, p.ProductNumber, p.ReleaseDate, p.ReleasedOn, tt.number, tt.releaseDate)
+		}
+		var attributes map[string]any
+		if err := json.Unmarshal(p.Attributes, &attributes); err != nil {
+			t.Fatalf("%s: attributes %s: %v", tt.name, p.Attributes, err)
+		}
+		if !reflect.DeepEqual(attributes, tt.attributes) {
+			t.Errorf("%s: attributes = %v, want %v", tt.name, attributes, tt.attributes)
+		}
+		if string(p.CustomAttributes) != tt.attrs {
+			t.Errorf("%s: raw custom attributes not kept", tt.name)
+		}
+	}
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	want := time.Date(2002, time.March, 8, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date string
+		ok   bool
+	}{
+		{"2002-03-08T00:00:00Z", true},
+		{"2002-03-08T00:00:00", true},
+		{"2002-03-08", true},
+		{"03/08/2002", true},
+		{"3/8/2002", true},
+		{" 2002-03-08 ", true},
+		{"", false},
+		{"March 8, 2002", false},
+		{"2002-13-08", false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseReleaseDate(tt.date)
+		if ok != tt.ok || (ok && !got.Equal(want)) || (!ok && !got.IsZero()) {
+			t.Errorf("ParseReleaseDate(%q) = %v, %t, want %t", tt.date, got, ok, tt.ok)
+		}
+	}
+}
+
+func TestExtractProductAttributesUnparsedDate(t *testing.T) {
+	products := []datastore.Product{{CustomAttributes: json.RawMessage(`{"number": "LOB-001", "releaseDate": "Spring 2002"}`)}}
+	extractProductAttributes(products)
+	if p := products[0]; p.ReleaseDate != "Spring 2002" || !p.ReleasedOn.IsZero() {
+		t.Errorf("release date %q (%v), want the raw string kept with a zero time", p.ReleaseDate, p.ReleasedOn)
+	}
+}
+
+func TestFetchProductsInPartsSorted(t *testing.T) {
+	const total = 2*MAX_RESULT_SIZE + 20
+	c, api := newStubClient(t, total)
+	sParams := NewSearchParams("yugioh", "metal-raiders", "", 0, total)
+	sParams.Sort = DEFAULT_SCRAPE_SORT
+	products, _ := c.FetchProductsInParts(context.Background(), sParams)
+
+	for _, s := range api.Searches() {
+		if s.Sort != (sort{Field: "number", Order: "asc"}) {
+			t.Errorf("page at offset %d sorted by %+v, want number asc", s.From, s.Sort)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, p := range products {
+		if seen[p.ProductId] {
+			t.Errorf("product %d fetched twice", p.ProductId)
+		}
+		seen[p.ProductId] = true
+	}
+	for id := 1; id <= total; id++ {
+		if !seen[id] {
+			t.Errorf("product %d missed", id)
+		}
+	}
+}
+
+func TestSanitizeProductNumber(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"LOB-001", "LOB-001"},
+		{"  4/102 ", "4/102"}, // Slashes are kept, escaped where numbers are used in paths
+		{"../../etc/passwd", "../../etc/passwd"},
+		{"LOB\x00001", ""},
+		{"LOB-001\n", "LOB-001"}, // Trailing whitespace is trimmed, not rejected
+		{"LOB\n001", ""},
+		{strings.Repeat("9", MAX_PRODUCT_NUMBER_LEN), strings.Repeat("9", MAX_PRODUCT_NUMBER_LEN)},
+		{strings.Repeat("9", MAX_PRODUCT_NUMBER_LEN+1), ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizeProductNumber(tt.number); got != tt.want {
+			t.Errorf("SanitizeProductNumber(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestParseProductId(t *testing.T) {
+	tests := []struct {
+		n    json.Number
+		want int
+		ok   bool
+	}{
+		{"21724", 21724, true},
+		{"21724.0", 21724, true},
+		{"2.1724e4", 21724, true},
+		{"9007199254740993", 9007199254740993, true}, // Above 2^53, exact as an integer
+		{"9007199254740992.0", 0, false},             // 2^53, which 2^53 + 1 rounds to
+		{"9007199254740994.0", 0, false},             // 2^53 and above in floating point form may have been rounded
+		{"9007199254740991.0", 9007199254740991, true},
+		{"1e300", 0, false},
+		{"21724.5", 0, false},
+		{"abc", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseProductId(tt.n)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseProductId(%q) = %d, %v, want %d, ok %t", tt.n, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestToProductsLargeId(t *testing.T) {
+	var results SearchResults
+	data := `{"results": [{"results": [
+		{"productId": 9007199254740993, "productName": "Large"},
+		{"productId": 1.5, "productName": "Fractional"},
+		{"productId": 21724.0, "productName": "Float"}]}]}`
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		t.Fatal(err)
+	}
+	products := toProducts(results.Results[0].Results)
+	if len(products) != 2 || products[0].ProductId != 9007199254740993 || products[1].ProductId != 21724 {
+		t.Errorf("toProducts() = %+v, want ids 9007199254740993 and 21724 with the fractional id dropped", products)
+	}
+}
+
+func TestFetchProductsInPartsPageError(t *testing.T) {
+	const total = 2*MAX_RESULT_SIZE + 1
+	tests := []struct {
+		name string
+		body []byte
+		want error
+	}{
+		{"reshaped page", []byte(`{"data": {"products": []}}`), ErrSchemaChange},
+		{"malformed page", []byte(`<html>Service Unavailable</html>`), ErrSchemaChange},
+		{"oversized page", []byte(`{"results": [{"results": [], "totalResults": 101, "padding": "` +
+			strings.Repeat("x", 1<<20) + `"}]}`), ErrResponseTooLarge},
+	}
+	for _, tt := range tests {
+		c, api := newStubClient(t, total)
+		c.MaxSearchResponseSize = 1 << 19 // Larger than a page, smaller than the oversized page
+		api.pages = map[int][]byte{MAX_RESULT_SIZE: tt.body}
+		products, stats := c.FetchProductsInParts(context.Background(), NewSearchParams("yugioh", "metal-raiders", "", 0, total))
+		if !errors.Is(stats.Err, tt.want) {
+			t.Errorf("%s: error = %v, want %v", tt.name, stats.Err, tt.want)
+		}
+		if len(products) != MAX_RESULT_SIZE || stats.Calls != 2 {
+			t.Errorf("%s: %d products after %d calls, want the first page's %d after 2", tt.name, len(products), stats.Calls, MAX_RESULT_SIZE)
+		}
+	}
+}
+
+func TestFetchProductsInPartsRetry(t *testing.T) {
+	const total = 2*MAX_RESULT_SIZE + 1
+	tests := []struct {
+		name     string
+		failures int    // Number of 503 responses to the second page
+		body     []byte // Body served as the second page, if not nil
+		products int
+		calls    int
+		want     error
+	}{
+		{"unavailable once", 1, nil, total, 4, nil},
+		{"unavailable", EMPTY_PAGE_ATTEMPTS, nil, MAX_RESULT_SIZE, 1 + EMPTY_PAGE_ATTEMPTS, ErrUnexpectedStatus},
+		{"no total", 0, []byte(`{"results": [{"results": []}]}`), total - MAX_RESULT_SIZE, 2 + EMPTY_PAGE_ATTEMPTS, nil},
+	}
+	for _, tt := range tests {
+		c, api := newStubClient(t, total)
+		api.failures = map[int]int{MAX_RESULT_SIZE: tt.failures}
+		if tt.body != nil {
+			api.pages = map[int][]byte{MAX_RESULT_SIZE: tt.body}
+		}
+		products, stats := c.FetchProductsInParts(context.Background(), NewSearchParams("yugioh", "metal-raiders", "", 0, total))
+		if !errors.Is(stats.Err, tt.want) || (tt.want == nil && stats.Err != nil) {
+			t.Errorf("%s: error = %v, want %v", tt.name, stats.Err, tt.want)
+		}
+		if len(products) != tt.products || stats.Calls != tt.calls {
+			t.Errorf("%s: %d products after %d calls, want %d after %d", tt.name, len(products), stats.Calls, tt.products, tt.calls)
+		}
+	}
+}
+
+func TestFetchProductsInPartsCanceledRetry(t *testing.T) {
+	c, api := newStubClient(t, 3)
+	api.failures = map[int]int{0: EMPTY_PAGE_ATTEMPTS}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(EMPTY_PAGE_RETRY_DELAY/10, cancel)
+
+	start := time.Now()
+	products, stats := c.FetchProductsInParts(ctx, NewSearchParams("yugioh", "metal-raiders", "", 0, 3))
+	if elapsed := time.Since(start); elapsed >= EMPTY_PAGE_RETRY_DELAY {
+		t.Errorf("FetchProductsInParts() returned after %v, want before the %v retry delay", elapsed, EMPTY_PAGE_RETRY_DELAY)
+	}
+	if !errors.Is(stats.Err, context.Canceled) || len(products) != 0 || stats.Calls != 1 {
+		t.Errorf("%d products after %d calls, error %v, want none after 1 with context.Canceled", len(products), stats.Calls, stats.Err)
+	}
+}
+
+func TestCaptureRawProducts(t *testing.T) {
+	defer func(capture bool) { CaptureRawProducts = capture }(CaptureRawProducts)
+	page := []byte(`{"results": [{"totalResults": 1, "results": [{"productId": 21724, "productName": "Blue-Eyes White Dragon",
+		"marketPrice": 87.5, "sellers": 312, "customAttributes": {"number": "LOB-001"}}]}]}`)
+
+	for _, capture := range []bool{true, false} {
+		CaptureRawProducts = capture
+		c, api := newStubClient(t, 1)
+		api.pages = map[int][]byte{0: page}
+		products, stats := c.FetchProductsInParts(context.Background(), NewSearchParams("yugioh", "legend-of-blue-eyes-white-dragon", "", 0, 1))
+		if stats.Err != nil || len(products) != 1 {
+			t.Fatalf("capture %t: %d products, error %v, want 1", capture, len(products), stats.Err)
+		}
+		raw := products[0].Raw
+		if !capture {
+			if raw != nil {
+				t.Errorf("capture off: Raw = %s, want nil", raw)
+			}
+			continue
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			t.Fatalf("capture on: Raw %s: %v", raw, err)
+		}
+		if fields["marketPrice"] != 87.5 || fields["sellers"] != 312.0 || fields["productName"] != "Blue-Eyes White Dragon" {
+			t.Errorf("capture on: Raw = %s, want the unmodeled upstream fields kept", raw)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package tcapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// responseCache stores raw search responses on disk, keyed by a hash of the search
+// endpoint and search parameters.
+type responseCache struct {
+	dir string        // Directory holding cached responses
+	ttl time.Duration // Maximum age of a cached response before it is refetched
+}
+
+// cacheKey returns the cache file name for a search request. The key covers every
+// field of sParams, including From and Size, so paginated requests don't collide.
+func cacheKey(url string, sParams SearchParams) string {
+	params, _ := json.Marshal(sParams)
+	sum := sha256.Sum256(append([]byte(url+"\n"), params...))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// get returns the cached response for key if one exists and is younger than the cache TTL.
+func (rc *responseCache) get(key string) ([]byte, bool) {
+	path := filepath.Join(rc.dir, key)
+	info, err := os.Stat(path)
+	if err != nil || nowFunc().Sub(info.ModTime()) > rc.ttl {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores a response under key, writing to a temporary file first so concurrent
+// readers never see a partial response.
+func (rc *responseCache) put(key string, data []byte) error {
+	tmp, err := os.CreateTemp(rc.dir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Error creating cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing cache file: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(rc.dir, key))
+}
+
+// EnableCache caches search responses in dir, reusing cached responses younger than ttl
+// instead of calling the TCGPlayer API.
+func (c *Client) EnableCache(dir string, ttl time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error creating cache directory '%s': %w", dir, err)
+	}
+	c.cache = &responseCache{dir: dir, ttl: ttl}
+	return nil
+}
@@ -0,0 +1,102 @@
+package tcapi
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	const url = "https://mp-search-api.tcgplayer.com/v1/search/request"
+	base := NewSearchParams("yugioh", "metal-raiders", "", 0, MAX_RESULT_SIZE)
+	nextPage := base
+	nextPage.From = MAX_RESULT_SIZE
+	shortPage := base
+	shortPage.Size = 1
+
+	if cacheKey(url, base) != cacheKey(url, NewSearchParams("yugioh", "metal-raiders", "", 0, MAX_RESULT_SIZE)) {
+		t.Errorf("cacheKey() differs for the same search")
+	}
+	keys := map[string]string{
+		"first page":         cacheKey(url, base),
+		"next page":          cacheKey(url, nextPage),
+		"short page":         cacheKey(url, shortPage),
+		"other endpoint":     cacheKey(url+"?mpfev=1", base),
+		"other set":          cacheKey(url, NewSearchParams("yugioh", "spell-ruler", "", 0, MAX_RESULT_SIZE)),
+		"other product type": cacheKey(url, NewSearchParams("yugioh", "metal-raiders", "Cards", 0, MAX_RESULT_SIZE)),
+	}
+	seen := make(map[string]string)
+	for name, key := range keys {
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s searches have the same cache key %s", name, other, key)
+		}
+		seen[key] = name
+	}
+}
+
+// newCachedStubClient returns a stub client caching search responses in a temporary directory
+// for ttl, with nowFunc replaced by a clock returned for the test to advance.
+func newCachedStubClient(t *testing.T, total int, ttl time.Duration) (*Client, *stubAPI, *time.Time) {
+	t.Helper()
+	c, api := newStubClient(t, total)
+	if err := c.EnableCache(t.TempDir(), ttl); err != nil {
+		t.Fatalf("EnableCache() error: %v", err)
+	}
+	now := time.Now()
+	stored := nowFunc
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = stored })
+	return c, api, &now
+}
+
+func TestCacheExpiry(t *testing.T) {
+	const ttl = time.Hour
+	c, api, now := newCachedStubClient(t, 3, ttl)
+	sParams := NewSearchParams("yugioh", "metal-raiders", "", 0, 3)
+
+	tests := []struct {
+		name     string
+		advance  time.Duration // Time passed since the previous fetch, the first cached at about the start
+		searches int           // Searches sent in total after the fetch
+	}{
+		{"first fetch", 0, 1},
+		{"cached", ttl / 2, 1},
+		{"cached until the TTL", ttl/2 - time.Minute, 1},
+		{"expired", 2 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		*now = now.Add(tt.advance)
+		products, stats := c.FetchProductsInParts(context.Background(), sParams)
+		if stats.Err != nil || len(products) != 3 {
+			t.Fatalf("%s: %d products, error %v, want 3", tt.name, len(products), stats.Err)
+		}
+		if n := len(api.Searches()); n != tt.searches {
+			t.Errorf("%s: %d searches sent, want %d", tt.name, n, tt.searches)
+		}
+	}
+}
+
+func TestCacheSkipsEmptyPages(t *testing.T) {
+	c, api, _ := newCachedStubClient(t, 0, time.Hour)
+	sParams := NewSearchParams("yugioh", "metal-raiders", "", 0, 3)
+
+	for i := 1; i <= 2; i++ {
+		if products, stats := c.FetchProductsInParts(context.Background(), sParams); len(products) != 0 || stats.Err != nil {
+			t.Fatalf("fetch %d: %d products, error %v, want none", i, len(products), stats.Err)
+		}
+		if n := len(api.Searches()); n != i {
+			t.Errorf("fetch %d: %d searches sent, want %d, the empty page refetched", i, n, i)
+		}
+	}
+	if entries, err := os.ReadDir(c.cache.dir); err != nil || len(entries) != 0 {
+		t.Errorf("cache directory holds %d entries, %v, want none for an empty page", len(entries), err)
+	}
+
+	// Size 0 searches, made for their aggregations, have no products to check, so are cached
+	c.FetchSetsByProductLine("yugioh", "")
+	c.FetchSetsByProductLine("yugioh", "")
+	if n := len(api.Searches()); n != 3 {
+		t.Errorf("%d searches sent after fetching sets twice, want 3, the sets aggregation cached", n)
+	}
+}
@@ -0,0 +1,237 @@
+package tcapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gurbos/tcd/datastore"
+)
+
+// Config holds the TCGPlayer API endpoints used by a Client.
+type Config struct {
+	BaseSearchURL     string // Search endpoint for products and aggregations
+	ProductLinesURL   string // Product lines endpoint
+	ProductDetailsURL string // Product details endpoint, formatted with the product Id
+	BaseImageURL      string // Image CDN base URL, followed by the image file name
+}
+
+// Return a Config holding the production TCGPlayer API endpoints.
+func DefaultConfig() Config {
+	return Config{
+		BaseSearchURL:     DATA_SEARCH_URL,
+		ProductLinesURL:   PRODUCT_LINES_URL,
+		ProductDetailsURL: PRODUCT_DETAILS_URL,
+		BaseImageURL:      BASE_IMAGE_URL,
+	}
+}
+
+// Client fetches data from the TCGPlayer API. Its HTTP clients are shared across
+// requests so connections are reused.
+type Client struct {
+	Config                Config          // API endpoints
+	ImageSpec             ImageSpec       // Size and format of product images to fetch
+	MaxSearchResponseSize int64           // Maximum size in bytes of a search or product response body
+	MaxImageResponseSize  int64           // Maximum size in bytes of an image response body
+	SearchTimeout         time.Duration   // Timeout of each search or product request, 0 disables
+	ImageTimeout          time.Duration   // Timeout of each image request, 0 disables
+	Headers               http.Header     // Headers added to, or replacing, the default request headers; an empty value removes the header
+	searchClient          *http.Client    // HTTP client used for search and product requests
+	imageClient           *http.Client    // HTTP client used for image requests
+	cache                 *responseCache  // On-disk search response cache, nil if disabled
+	transport             *http.Transport // Transport shared by the search and image HTTP clients
+}
+
+// Return a new Client using the production API endpoints and default settings.
+func NewClient() *Client {
+	return NewClientWithConfig(DefaultConfig())
+}
+
+// Return a new Client using the API endpoints in config and default settings.
+// Requests go through the proxy named by the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment
+// variables, unless overridden with SetProxy.
+func NewClientWithConfig(config Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	return &Client{
+		Config:                config,
+		ImageSpec:             DefaultImageSpec,
+		MaxSearchResponseSize: DEFAULT_MAX_SEARCH_RESPONSE_SIZE,
+		MaxImageResponseSize:  DEFAULT_MAX_IMAGE_RESPONSE_SIZE,
+		SearchTimeout:         DEFAULT_SEARCH_TIMEOUT,
+		ImageTimeout:          DEFAULT_IMAGE_TIMEOUT,
+		searchClient:          &http.Client{Transport: transport},
+		imageClient:           &http.Client{Transport: transport},
+		transport:             transport,
+	}
+}
+
+// withTimeout derives a context for a single request bounded by timeout. Timeouts are applied
+// per request rather than on the shared HTTP clients, so each request gets its own deadline
+// and a non-positive timeout leaves ctx unbounded.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// mergeHeaders sets the client's Headers on req, replacing any default header of the same name.
+// A header whose only value is empty is removed instead.
+func (c *Client) mergeHeaders(req *http.Request) {
+	for name, values := range c.Headers {
+		req.Header.Del(name)
+		for _, value := range values {
+			if value != "" {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+}
+
+// SetProxy routes search and image requests through the proxy at proxyURL, overriding the proxy
+// environment variables. An empty proxyURL restores the environment proxy settings.
+func (c *Client) SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		c.transport.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL '%s', expected a URL such as http://proxy.example.com:8080", proxyURL)
+	}
+	c.transport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// RoundTripperFunc adapts a function to an http.RoundTripper, so a Client can be pointed at a
+// stub serving canned responses in place of the TCGPlayer API.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req).
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// SetTransport sends search and image requests through rt in place of the client's default
+// transport. Proxy settings from SetProxy only apply to the default transport.
+func (c *Client) SetTransport(rt http.RoundTripper) {
+	c.searchClient.Transport = rt
+	c.imageClient.Transport = rt
+}
+
+// defaultClient backs the package-level fetch functions.
+var defaultClient = NewClient()
+
+// Ping issues a minimal search request to the TCGPlayer API, bypassing the response cache,
+// and returns an error if the API is unreachable or responds with a non-OK status.
+func (c *Client) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, c.SearchTimeout)
+	defer cancel()
+
+	reqBody := NewSearchFilter(NewSearchParams("", "", "", 0, 0))
+	req := InitRequest(http.MethodPost, c.Config.BaseSearchURL, reqBody)
+	c.mergeHeaders(req)
+	res, err := c.searchClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Error reaching TCGPlayer API: %w", err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body) // Drain body so the connection can be reused
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error reaching TCGPlayer API: unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Fetch product image from TCGPlayer API by product Id, in the client's image size and format.
+func (c *Client) FetchProductImageById(ctx context.Context, imageId int) ([]byte, error) {
+	return c.fetchProductImage(ctx, imageId, c.ImageSpec)
+}
+
+// Fetch product images from TCGPlayer API for several product Ids, with at most concurrency
+// requests in flight. Returns the image data and the fetch errors, each keyed by product Id.
+func (c *Client) FetchProductImages(ctx context.Context, ids []int, concurrency int) (map[int][]byte, map[int]error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	images := make(map[int][]byte)
+	errs := make(map[int]error)
+	sem := make(chan struct{}, max(concurrency, 1)) // Semaphore bounding concurrent fetches
+
+	for _, id := range ids {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			imgData, err := c.FetchProductImageById(ctx, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[id] = err
+				return
+			}
+			images[id] = imgData
+		}(id)
+	}
+	wg.Wait()
+	return images, errs
+}
+
+/*-------------------------------------------------------------------------------------------------*/
+// Package-level functions fetching from the production TCGPlayer API with a default Client.
+
+// Fetch product line data from TCGPlayer API using the default client.
+func FetchProductLineData(sParams SearchParams) SearchResults {
+	return defaultClient.FetchProductLineData(sParams)
+}
+
+// Return list of card sets for the specified product line using the default client.
+func FetchSetsByProductLine(productLine string, productType string) []datastore.Set {
+	return defaultClient.FetchSetsByProductLine(productLine, productType)
+}
+
+// Return list of all product lines using the default client.
+func FetchProductLines() []ValueType {
+	return defaultClient.FetchProductLines()
+}
+
+// Return the card type, rarity, and product type aggregations of a product line using the default client.
+func FetchAggregations(productLine string) ProductLineAggregations {
+	return defaultClient.FetchAggregations(productLine)
+}
+
+// Return the product line whose url name or display name matches name using the default client.
+func FetchProductLineByName(name string) *datastore.Product_Line {
+	return defaultClient.FetchProductLineByName(name)
+}
+
+// Return the products matching sParams using the default client.
+func FetchProducts(sParams SearchParams) []datastore.Product {
+	return defaultClient.FetchProducts(sParams)
+}
+
+// Return the total number of products matching sParams using the default client.
+func FetchProductCount(ctx context.Context, sParams SearchParams) (int, error) {
+	return defaultClient.FetchProductCount(ctx, sParams)
+}
+
+// Fetch all products matching sParams in parts using the default client.
+func FetchProductsInParts(ctx context.Context, sParams SearchParams) ([]datastore.Product, FetchStats) {
+	return defaultClient.FetchProductsInParts(ctx, sParams)
+}
+
+// Fetch a single product's details by product Id using the default client.
+func FetchProductById(ctx context.Context, productId int) (datastore.Product, error) {
+	return defaultClient.FetchProductById(ctx, productId)
+}
+
+// Fetch product image by product Id, in the size and format specified by spec, using the default client.
+func FetchProductImageById(ctx context.Context, imageId int, spec ImageSpec) ([]byte, error) {
+	return defaultClient.fetchProductImage(ctx, imageId, spec)
+}
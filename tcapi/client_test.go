@@ -0,0 +1,269 @@
+package tcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gurbos/tcd/datastore"
+)
+
+// stubAPI serves canned TCGPlayer API responses from the fixtures in testdata, recording the
+// search requests it receives. Size 0 searches are answered with the product lines fixture, or
+// the sets aggregation fixture when filtered by product line, which only counts cards when also
+// filtered by the Cards product type. Product searches are answered
+// with pages cut from total products, each a copy of a product of the products page fixture
+// with its id set to its offset plus 1, after the first emptyPages come back empty, unless pages
+// holds the body served at the offset, or failures says the offset's next searches are answered
+// with a 503. Image requests are answered with a 1x1 PNG.
+type stubAPI struct {
+	t          *testing.T
+	total      int            // Total number of products matched by product searches
+	emptyPages int            // Number of product searches answered with no products, as a flaky API does
+	pages      map[int][]byte // Response bodies served in place of the product pages at these offsets
+	failures   map[int]int    // Number of searches at these offsets answered with a 503 before the page
+	mu         sync.Mutex
+	searches   []SearchCriteria // Search requests received, in order
+	images     int              // Number of image requests received
+}
+
+// newStubClient returns a Client whose search and image requests are served by a stubAPI
+// matching total products, and the stubAPI.
+func newStubClient(t *testing.T, total int) (*Client, *stubAPI) {
+	t.Helper()
+	api := &stubAPI{t: t, total: total}
+	c := NewClient()
+	c.SetTransport(RoundTripperFunc(api.roundTrip))
+	return c, api
+}
+
+// Searches returns the search requests received so far.
+func (s *stubAPI) Searches() []SearchCriteria {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SearchCriteria(nil), s.searches...)
+}
+
+func (s *stubAPI) roundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && strings.HasPrefix(req.URL.String(), BASE_IMAGE_URL) {
+		s.mu.Lock()
+		s.images++
+		s.mu.Unlock()
+		return stubResponse("image/png", stubImage(s.t)), nil
+	}
+
+	var criteria SearchCriteria
+	if err := json.NewDecoder(req.Body).Decode(&criteria); err != nil {
+		s.t.Errorf("Error decoding search request: %v", err)
+		return stubResponse("application/json", nil), nil
+	}
+	s.mu.Lock()
+	s.searches = append(s.searches, criteria)
+	fail := s.failures[criteria.From] > 0 && criteria.Size > 0
+	if fail {
+		s.failures[criteria.From]--
+	}
+	s.mu.Unlock()
+
+	switch {
+	case fail:
+		res := stubResponse("text/html", []byte("<html>Service Unavailable</html>"))
+		res.Status, res.StatusCode = "503 Service Unavailable", http.StatusServiceUnavailable
+		return res, nil
+	case criteria.Size == 0 && len(criteria.Filters.Term.ProductLineName) == 0:
+		return stubResponse("application/json", readFixture(s.t, "product_lines.json")), nil
+	case criteria.Size == 0 && slices.Equal(criteria.Filters.Term.ProductTypeName, []string{"Cards"}):
+		return stubResponse("application/json", readFixture(s.t, "sets_aggregation_cards.json")), nil
+	case criteria.Size == 0 && len(criteria.Filters.Term.ProductTypeName) > 0:
+		s.t.Errorf("No sets aggregation fixture for product types %v", criteria.Filters.Term.ProductTypeName)
+		return stubResponse("application/json", nil), nil
+	case criteria.Size == 0:
+		return stubResponse("application/json", readFixture(s.t, "sets_aggregation.json")), nil
+	case s.pages[criteria.From] != nil:
+		return stubResponse("application/json", s.pages[criteria.From]), nil
+	default:
+		return stubResponse("application/json", s.productsPage(criteria.From, criteria.Size)), nil
+	}
+}
+
+// productsPage returns a products search response holding the products at offsets from up to
+// from + size, limited to the total.
+func (s *stubAPI) productsPage(from int, size int) []byte {
+	var fixture SearchResults
+	if err := json.Unmarshal(readFixture(s.t, "products_page.json"), &fixture); err != nil {
+		s.t.Fatalf("Error decoding products page fixture: %v", err)
+	}
+	templates := fixture.Results[0].Results
+
+	page := []Product{}
+	s.mu.Lock()
+	empty := s.emptyPages > 0
+	s.emptyPages--
+	s.mu.Unlock()
+	for i := from; i < min(from+size, s.total) && !empty; i++ {
+		p := templates[i%len(templates)]
+		p.ProductId = json.Number(strconv.Itoa(i + 1))
+		page = append(page, p)
+	}
+	data, err := json.Marshal(SearchResults{Results: []Results{{Results: page, TotalResults: s.total}}})
+	if err != nil {
+		s.t.Fatalf("Error encoding products page: %v", err)
+	}
+	return data
+}
+
+// readFixture returns the contents of the named file in testdata.
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Error reading fixture: %v", err)
+	}
+	return data
+}
+
+// stubImage returns a 1x1 PNG image.
+func stubImage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("Error encoding stub image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// stubResponse returns an OK response with the content type and body.
+func stubResponse(contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestStubFixtures(t *testing.T) {
+	c, api := newStubClient(t, 0)
+
+	lines := c.FetchProductLines()
+	if len(lines) != 5 || lines[1].UrlName != "yugioh" {
+		t.Errorf("FetchProductLines() = %v, want the 5 fixture product lines", lines)
+	}
+	sets := c.FetchSetsByProductLine("yugioh", "")
+	if len(sets) != 3 || sets[0].UrlName != "legend-of-blue-eyes-white-dragon" || sets[0].Count != 126 {
+		t.Errorf("FetchSetsByProductLine() = %v, want the 3 fixture sets", sets)
+	}
+	if aggs := c.FetchAggregations("yugioh"); len(aggs.Rarities) != 3 || len(aggs.ProductTypes) != 2 {
+		t.Errorf("FetchAggregations() = %+v, want the fixture aggregations", aggs)
+	}
+	if n := len(api.Searches()); n != 3 {
+		t.Errorf("%d searches sent, want 3", n)
+	}
+
+	images, errs := c.FetchProductImages(context.Background(), []int{21724, 21725}, 2)
+	if len(images) != 2 || len(errs) != 0 || api.images != 2 {
+		t.Errorf("FetchProductImages() = %d images, errors %v after %d requests, want 2 images", len(images), errs, api.images)
+	}
+}
+
+func TestFetchProductsInPartsPaging(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  int
+		size  int
+		pages [][2]int // From and size of each search request
+	}{
+		{"one short of a page", 0, MAX_RESULT_SIZE - 1, [][2]int{{0, MAX_RESULT_SIZE - 1}}},
+		{"exactly a page", 0, MAX_RESULT_SIZE, [][2]int{{0, MAX_RESULT_SIZE}}},
+		{"one over a page", 0, MAX_RESULT_SIZE + 1, [][2]int{{0, MAX_RESULT_SIZE}, {MAX_RESULT_SIZE, 1}}},
+		{"exactly two pages", 0, 2 * MAX_RESULT_SIZE, [][2]int{{0, MAX_RESULT_SIZE}, {MAX_RESULT_SIZE, MAX_RESULT_SIZE}}},
+		{"resumed at a page boundary", MAX_RESULT_SIZE, 2*MAX_RESULT_SIZE + 1,
+			[][2]int{{MAX_RESULT_SIZE, MAX_RESULT_SIZE}, {2 * MAX_RESULT_SIZE, 1}}},
+		{"resumed one short of the end", 2*MAX_RESULT_SIZE - 1, 2 * MAX_RESULT_SIZE, [][2]int{{2*MAX_RESULT_SIZE - 1, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, api := newStubClient(t, tt.size)
+			sParams := NewSearchParams("yugioh", "legend-of-blue-eyes-white-dragon", "", tt.from, tt.size)
+			products, _ := c.FetchProductsInParts(context.Background(), sParams)
+
+			var pages [][2]int
+			for _, s := range api.Searches() {
+				pages = append(pages, [2]int{s.From, s.Size})
+			}
+			if !slices.Equal(pages, tt.pages) {
+				t.Fatalf("pages requested = %v, want %v", pages, tt.pages)
+			}
+
+			if len(products) != tt.size-tt.from {
+				t.Fatalf("%d products returned, want %d", len(products), tt.size-tt.from)
+			}
+			for i, p := range products {
+				if p.ProductId != tt.from+i+1 {
+					t.Fatalf("product %d has id %d, want %d", i, p.ProductId, tt.from+i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchProducts(t *testing.T) {
+	c, _ := newStubClient(t, 3)
+	stored := defaultClient
+	defaultClient = c
+	defer func() { defaultClient = stored }()
+
+	sParams := NewSearchParams("yugioh", "legend-of-blue-eyes-white-dragon", "", 0, 3)
+	for name, fetch := range map[string]func(SearchParams) []datastore.Product{
+		"Client.FetchProducts": c.FetchProducts,
+		"FetchProducts":        FetchProducts, // Delegates to the default client
+	} {
+		products := fetch(sParams)
+		if len(products) != 3 {
+			t.Fatalf("%s() returned %d products, want 3", name, len(products))
+		}
+		p := products[0]
+		if p.ProductId != 1 || p.ProductName != "Blue-Eyes White Dragon" || p.SetUrlName != "legend-of-blue-eyes-white-dragon" ||
+			p.RarityName != "Ultra Rare" || !isJSONObject(p.CustomAttributes) {
+			t.Errorf("%s() first product = %+v, want the fixture's Blue-Eyes White Dragon converted", name, p)
+		}
+	}
+}
+
+func TestFetchSetsByProductLineProductType(t *testing.T) {
+	c, api := newStubClient(t, 0)
+	all := c.FetchSetsByProductLine("yugioh", "")
+	cards := c.FetchSetsByProductLine("yugioh", "Cards")
+
+	searches := api.Searches()
+	if len(searches) != 2 || len(searches[0].Filters.Term.ProductTypeName) != 0 ||
+		!slices.Equal(searches[1].Filters.Term.ProductTypeName, []string{"Cards"}) {
+		t.Fatalf("searches = %+v, want the second alone filtered by product type Cards", searches)
+	}
+	if len(all) != 3 || len(cards) != len(all) {
+		t.Fatalf("%d sets of all product types and %d of cards, want 3 of each", len(all), len(cards))
+	}
+	want := map[string][2]int{ // Counts of all product types and of cards, keyed by set url name
+		"legend-of-blue-eyes-white-dragon": {126, 121},
+		"metal-raiders":                    {144, 138},
+		"spell-ruler":                      {104, 104},
+	}
+	for i := range all {
+		if all[i].UrlName != cards[i].UrlName {
+			t.Fatalf("set %d is %s of all product types and %s of cards", i, all[i].UrlName, cards[i].UrlName)
+		}
+		if got := [2]int{all[i].Count, cards[i].Count}; got != want[all[i].UrlName] {
+			t.Errorf("set %s counts = %v of all product types and of cards, want %v", all[i].UrlName, got, want[all[i].UrlName])
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tcapi
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Maximum number of bytes of a request or response body written to the debug log.
+const DEBUG_BODY_LIMIT = 4096
+
+// debugTransport logs each request it sends, along with its response, before handing the
+// response back unchanged.
+type debugTransport struct {
+	next   http.RoundTripper
+	logger *log.Logger
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil { // Read a copy, leaving the request body unread
+			data, _ := io.ReadAll(io.LimitReader(body, DEBUG_BODY_LIMIT+1))
+			body.Close()
+			t.logger.Printf("HTTP request: %s %s\n%s", req.Method, req.URL, truncateBody(data))
+		}
+	} else {
+		t.logger.Printf("HTTP request: %s %s", req.Method, req.URL)
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.logger.Printf("HTTP response: %s %s: %v", req.Method, req.URL, err)
+		return res, err
+	}
+	if !isTextContent(res.Header.Get("Content-Type")) {
+		t.logger.Printf("HTTP response: %s %s: %s, %s body", req.Method, req.URL, res.Status, res.Header.Get("Content-Type"))
+		return res, nil
+	}
+
+	// Read the start of the body for the log, then put it back in front of the rest
+	prefix, _ := io.ReadAll(io.LimitReader(res.Body, DEBUG_BODY_LIMIT+1))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), res.Body), res.Body}
+	t.logger.Printf("HTTP response: %s %s: %s\n%s", req.Method, req.URL, res.Status, truncateBody(prefix))
+	return res, nil
+}
+
+// truncateBody returns data as a string, cut to DEBUG_BODY_LIMIT bytes with a marker if longer.
+func truncateBody(data []byte) string {
+	if len(data) > DEBUG_BODY_LIMIT {
+		return string(data[:DEBUG_BODY_LIMIT]) + "... (truncated)"
+	}
+	return string(data)
+}
+
+// isTextContent reports whether a response of the content type can be logged as text.
+func isTextContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json")
+}
+
+// EnableDebugLog writes each search, product, and image request sent by the client to logger,
+// with its request body, response status, and text response body, each body cut to
+// DEBUG_BODY_LIMIT bytes. Search responses served from the cache are not sent, so not logged.
+// Call it after SetTransport, which replaces the logging transport.
+func (c *Client) EnableDebugLog(logger *log.Logger) {
+	c.searchClient.Transport = &debugTransport{next: transportOrDefault(c.searchClient.Transport), logger: logger}
+	c.imageClient.Transport = &debugTransport{next: transportOrDefault(c.imageClient.Transport), logger: logger}
+}
+
+// transportOrDefault returns rt, or http.DefaultTransport if rt is nil.
+func transportOrDefault(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		return http.DefaultTransport
+	}
+	return rt
+}
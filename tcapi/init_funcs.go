@@ -7,20 +7,58 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
-	PRODUCT_LINES_URL   = "https://mp-search-api.tcgplayer.com/v1/search/productLines"
-	DATA_SEARCH_URL     = "https://mp-search-api.tcgplayer.com/v1/search/request?q=&isList=false"
-	BASE_IMAGE_URL      = "https://tcgplayer-cdn.tcgplayer.com/product/"
-	IMAGE_FORMAT_SUFFIX = "1000x1000.jpg"
+	PRODUCT_LINES_URL        = "https://mp-search-api.tcgplayer.com/v1/search/productLines"
+	DATA_SEARCH_URL          = "https://mp-search-api.tcgplayer.com/v1/search/request?q=&isList=false"
+	PRODUCT_DETAILS_URL      = "https://mp-search-api.tcgplayer.com/v2/product/%d/details"
+	BASE_IMAGE_URL           = "https://tcgplayer-cdn.tcgplayer.com/product/"
+	DEFAULT_IMAGE_SIZE       = "in_1000x1000"
+	DEFAULT_IMAGE_FORMAT     = "jpg"
+	DEFAULT_SHIPPING_COUNTRY = "US" // Shipping country searches are priced for when none is specified
+
+	// Sort option used when scraping. The API default sales_dismax relevance order isn't stable
+	// between requests, so products can shift across page boundaries while a set is paged,
+	// being missed on one page and repeated on the next. Ordering by number keeps pages consistent;
+	// products sharing a number within a set are deduplicated to one anyway.
+	DEFAULT_SCRAPE_SORT = "number-asc"
 
 	// Maximum number of product results returned by TCGPlayer API in a single response.
 	// Used by FetchProductsInParts to limit number of products requested per API call to
 	// FetchProducts.
 	MAX_RESULT_SIZE = 50
+
+	// Attempts made to fetch a page that comes back empty when products are expected, and the
+	// delay between attempts.
+	EMPTY_PAGE_ATTEMPTS    = 3
+	EMPTY_PAGE_RETRY_DELAY = time.Second
+
+	// Minimum number of products fetched for a set before the share of products whose custom
+	// attributes couldn't be parsed is taken as a sign of an API schema change.
+	SCHEMA_CHECK_MIN_PRODUCTS = 10
+
+	// Maximum length of a product number, the size of the products.product_number column.
+	MAX_PRODUCT_NUMBER_LEN = 30
+
+	// Default maximum response body sizes, guarding against unexpectedly huge responses.
+	DEFAULT_MAX_SEARCH_RESPONSE_SIZE = 8 << 20  // 8 MiB
+	DEFAULT_MAX_IMAGE_RESPONSE_SIZE  = 16 << 20 // 16 MiB
+
+	// Default timeouts of a single request, including reading the response body. Search pages
+	// can be large and slow to serve, while images are small and should fail fast.
+	DEFAULT_SEARCH_TIMEOUT = 60 * time.Second
+	DEFAULT_IMAGE_TIMEOUT  = 15 * time.Second
 )
 
+// CaptureRawProducts controls whether the entire JSON of each fetched product is kept in
+// Product.Raw, preserving upstream fields not modeled by Product at the cost of memory
+// and storage.
+var CaptureRawProducts = false
+
 func InitRequest(method string, url string, body io.Reader) *http.Request {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -43,36 +81,47 @@ func NewSearchFilter(sParams SearchParams) io.Reader {
 	return bytes.NewReader(data)
 }
 
-// Initialize a new SearchCriteria struct with the values specified in sParams
+// Initialize a new SearchCriteria struct with the values specified in sParams.
+// The productLineName and setName term filters match url names (e.g. "pokemon-japan"),
+// not display names, so sParams.ProductLine and sParams.SetName are normalized with UrlName.
 func InitSearchCriteria(sParams SearchParams) SearchCriteria {
 	var criteria SearchCriteria
 	if sParams.ProductLine != "" {
-		criteria.Filters.Term.ProductLineName = []string{sParams.ProductLine}
+		criteria.Filters.Term.ProductLineName = []string{UrlName(sParams.ProductLine)}
 	}
 	if sParams.SetName != "" {
-		criteria.Filters.Term.SetName = []string{sParams.SetName}
+		criteria.Filters.Term.SetName = []string{UrlName(sParams.SetName)}
 	}
 	if sParams.ProductType != "" {
 		criteria.Filters.Term.ProductTypeName = []string{sParams.ProductType}
 	}
+	if len(sParams.Rarities) > 0 {
+		criteria.Filters.Term.RarityName = sParams.Rarities
+	}
 	criteria.From = sParams.From
 	criteria.Size = sParams.Size
 	criteria.Algorithm = "sales_dismax"
-	criteria.Context.ShippingCountry = "US"
+	criteria.Context.ShippingCountry = sParams.ShippingCountry
+	if criteria.Context.ShippingCountry == "" {
+		criteria.Context.ShippingCountry = DEFAULT_SHIPPING_COUNTRY
+	}
 	criteria.ListingSearch.Filters.Exclude.ChannelExclusion = 0
 	criteria.ListingSearch.Filters.Range.Quantity.Gte = 1
 	criteria.ListingSearch.Filters.Term.ChannelId = 0
 	criteria.ListingSearch.Filters.Term.SellerStatus = "Live"
 	criteria.Settings.UseFuzzySearch = true
+	criteria.Sort = toSort(sParams.Sort)
 	return criteria
 }
 
 // Initialize HTTP request headers according to request headers spcecified
 // in https://www.tcgplayer.com request/response via browser developer tools
 // file request?q=&isList=false in Network tab file field.
+// Accept-Encoding is left to the HTTP transport, which requests gzip and transparently
+// decompresses the response; setting it here would disable that decompression.
+// Client.Headers are merged over these defaults for requests made by a Client.
 func InitRequestHeader(req *http.Request) {
 	req.Header.Set("Accept", "application/json, text/plain, */*")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Content-Type", "application/json")
@@ -87,14 +136,66 @@ func InitRequestHeader(req *http.Request) {
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:147.0) Gecko/20100101 Firefox/147.0")
 }
 
+// Return an ImageSpec for the specified image size and format, validated against
+// the sizes and formats served by the TCGPlayer CDN.
+func NewImageSpec(size string, format string) (ImageSpec, error) {
+	spec := ImageSpec{Size: size, Format: format}
+	if !slices.Contains(ImageSizes, size) {
+		return spec, fmt.Errorf("invalid image size '%s', valid sizes are: %s", size, strings.Join(ImageSizes, ", "))
+	}
+	if !slices.Contains(ImageFormats, format) {
+		return spec, fmt.Errorf("invalid image format '%s', valid formats are: %s", format, strings.Join(ImageFormats, ", "))
+	}
+	return spec, nil
+}
+
+// Return an error if country is not a two-letter uppercase country code.
+func ValidateShippingCountry(country string) error {
+	valid := len(country) == 2
+	for _, c := range country {
+		valid = valid && c >= 'A' && c <= 'Z'
+	}
+	if !valid {
+		return fmt.Errorf("invalid shipping country '%s', expected a two-letter country code such as US", country)
+	}
+	return nil
+}
+
+// Return an error if option is not empty and not one of SortOptions.
+func ValidateSort(option string) error {
+	if option != "" && !slices.Contains(SortOptions, option) {
+		return fmt.Errorf("invalid sort '%s', valid sorts are: %s", option, strings.Join(SortOptions, ", "))
+	}
+	return nil
+}
+
+// Return the search sort for a sort option. Empty and unknown options return an empty sort,
+// which keeps the API default order.
+func toSort(option string) sort {
+	if !slices.Contains(SortOptions, option) {
+		return sort{}
+	}
+	i := strings.LastIndex(option, "-")
+	return sort{Field: sortFields[option[:i]], Order: option[i+1:]}
+}
+
 // Return a SearchParams struct initialized with default values
 func NewSearchParams(productLine string, setName string, productType string, from int, size int) SearchParams {
 	params := SearchParams{
-		From:        from,
-		Size:        size,
-		ProductLine: productLine,
-		SetName:     setName,
-		ProductType: productType,
+		From:            from,
+		Size:            size,
+		ProductLine:     productLine,
+		SetName:         setName,
+		ProductType:     productType,
+		ShippingCountry: DEFAULT_SHIPPING_COUNTRY,
 	}
 	return params
 }
+
+// Return name in the url name form expected by the search API term filters. Url names are
+// returned unchanged; display names are lower cased with runs of spaces replaced by a hyphen,
+// which matches TCGPlayer url names for most product lines and sets (e.g. "Pokemon Japan"
+// becomes "pokemon-japan"). Prefer passing the url name from ValueType.UrlName when it's known.
+func UrlName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
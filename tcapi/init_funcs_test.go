@@ -0,0 +1,70 @@
+package tcapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// marshaledTerm returns the term filters of the search request body marshaled for sParams.
+func marshaledTerm(t *testing.T, sParams SearchParams) map[string]any {
+	t.Helper()
+	var body struct {
+		Filters struct {
+			Term map[string]any `json:"term"`
+		} `json:"filters"`
+	}
+	if err := json.NewDecoder(NewSearchFilter(sParams)).Decode(&body); err != nil {
+		t.Fatalf("Error decoding search request: %v", err)
+	}
+	return body.Filters.Term
+}
+
+func TestInitSearchCriteriaRarities(t *testing.T) {
+	tests := []struct {
+		name     string
+		rarities []string
+		want     map[string]any
+	}{
+		{"none", nil, map[string]any{"productLineName": []any{"yugioh"}}},
+		{"one", []string{"Secret Rare"},
+			map[string]any{"productLineName": []any{"yugioh"}, "rarityName": []any{"Secret Rare"}}},
+		{"several", []string{"Secret Rare", "Ultra Rare"},
+			map[string]any{"productLineName": []any{"yugioh"}, "rarityName": []any{"Secret Rare", "Ultra Rare"}}},
+	}
+	for _, tt := range tests {
+		sParams := NewSearchParams("yugioh", "", "", 0, 50)
+		sParams.Rarities = tt.rarities
+		if got := marshaledTerm(t, sParams); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: term filters = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInitSearchCriteriaUrlNames(t *testing.T) {
+	tests := []struct {
+		productLine, setName string
+		want                 map[string]any
+	}{
+		{"pokemon-japan", "", map[string]any{"productLineName": []any{"pokemon-japan"}}},
+		{"Pokemon Japan", "", map[string]any{"productLineName": []any{"pokemon-japan"}}}, // Display name converted
+		{"yugioh", "Legend of Blue Eyes White Dragon", map[string]any{
+			"productLineName": []any{"yugioh"}, "setName": []any{"legend-of-blue-eyes-white-dragon"}}},
+		{"", "", map[string]any{}},
+	}
+	for _, tt := range tests {
+		got := marshaledTerm(t, NewSearchParams(tt.productLine, tt.setName, "", 0, 0))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("InitSearchCriteria(%q, %q) term filters = %v, want %v", tt.productLine, tt.setName, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSetsByProductLineUrlName(t *testing.T) {
+	c, api := newStubClient(t, 0)
+	c.FetchSetsByProductLine("yugioh", "")
+	searches := api.Searches()
+	if len(searches) != 1 || !reflect.DeepEqual(searches[0].Filters.Term.ProductLineName, []string{"yugioh"}) {
+		t.Errorf("searches = %+v, want one filtered by product line url name yugioh", searches)
+	}
+}
@@ -45,6 +45,7 @@ type _term struct {
 	ProductLineName []string `json:"productLineName,omitempty"`
 	SetName         []string `json:"setName,omitempty"`
 	ProductTypeName []string `json:"productTypeName,omitempty"`
+	RarityName      []string `json:"rarityName,omitempty"`
 }
 
 /******************************************************************/
@@ -93,7 +94,10 @@ type settings struct {
 type _didYouMean struct{}
 
 /******************************************************************/
-type sort struct{}
+type sort struct {
+	Field string `json:"field,omitempty"`
+	Order string `json:"order,omitempty"`
+}
 
 /******************************************************************/
 
@@ -109,6 +113,26 @@ type Error struct{}
 type Results struct {
 	Aggregations aggregations `json:"aggregations"`
 	Results      []Product    `json:"results"`
+	TotalResults int          `json:"totalResults"` // Total number of matching products across all pages
+	hasTotal     bool         // Whether the response included totalResults
+}
+
+// UnmarshalJSON decodes results, recording whether totalResults was included so a missing
+// total can be told apart from a total of 0.
+func (r *Results) UnmarshalJSON(data []byte) error {
+	type results Results // Alias without methods to avoid recursing into UnmarshalJSON
+	aux := struct {
+		*results
+		TotalResults *int `json:"totalResults"`
+	}{results: (*results)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	r.TotalResults, r.hasTotal = 0, aux.TotalResults != nil
+	if r.hasTotal {
+		r.TotalResults = *aux.TotalResults
+	}
+	return nil
 }
 
 /******************************************************************/
@@ -122,14 +146,29 @@ type aggregations struct {
 	Condition       []ValueType `json:"condition"`
 }
 
+// Structure for holding the aggregation values used to filter a product line's products
+type ProductLineAggregations struct {
+	CardTypes    []ValueType
+	Rarities     []ValueType
+	ProductTypes []ValueType
+}
+
 type ValueType struct {
 	Name    string  `json:"value"`
 	UrlName string  `json:"urlValue"`
 	Count   float64 `json:"count"`
 }
 
+// String returns the display name followed by the url name, when it differs.
+func (v ValueType) String() string {
+	if v.UrlName == "" || v.UrlName == v.Name {
+		return v.Name
+	}
+	return v.Name + " (" + v.UrlName + ")"
+}
+
 type Product struct {
-	ProductId          float64         `json:"productId"`
+	ProductId          json.Number     `json:"productId"` // Kept as the JSON number text so large ids aren't rounded
 	ProductLineName    string          `json:"productLineName"`
 	ProductLineUrlName string          `json:"productLineUrlName"`
 	ProductName        string          `json:"productName"`
@@ -143,6 +182,20 @@ type Product struct {
 	ReleaseDate        string
 	ProductLineId      int
 	SetId              int
+	Raw                json.RawMessage `json:"-"` // Entire product JSON, captured when CaptureRawProducts is set
+}
+
+// UnmarshalJSON decodes a product and, when CaptureRawProducts is set, keeps the entire
+// product JSON in Raw so fields not modeled by Product are preserved.
+func (p *Product) UnmarshalJSON(data []byte) error {
+	type product Product // Alias without methods to avoid recursing into UnmarshalJSON
+	if err := json.Unmarshal(data, (*product)(p)); err != nil {
+		return err
+	}
+	if CaptureRawProducts {
+		p.Raw = append(json.RawMessage(nil), data...)
+	}
+	return nil
 }
 
 /******************************************************************/
@@ -165,13 +218,69 @@ type Product struct {
 
 /*-------------------------------------------------------------------------------------------------*/
 
+// Image sizes and formats served by the TCGPlayer CDN
+var (
+	ImageSizes   = []string{"in_1000x1000", "in_400x400", "in_200x200", "400w", "200w"}
+	ImageFormats = []string{"jpg"}
+)
+
+// Structure for holding the size and format of product images requested from the TCGPlayer CDN
+type ImageSpec struct {
+	Size   string
+	Format string
+}
+
+// DefaultImageSpec is the image size and format requested when none is specified
+var DefaultImageSpec = ImageSpec{Size: DEFAULT_IMAGE_SIZE, Format: DEFAULT_IMAGE_FORMAT}
+
+// Suffix returns the image file name suffix, following the product Id, for the image spec.
+func (is ImageSpec) Suffix() string {
+	return is.Size + "." + is.Format
+}
+
+/*-------------------------------------------------------------------------------------------------*/
+
 // Structure for holding search parameters
 type SearchParams struct {
-	ProductLine string
-	SetName     string
-	ProductType string
-	From        int
-	Size        int
+	ProductLine     string // Product line url name, e.g. "pokemon"
+	SetName         string // Set url name
+	ProductType     string
+	From            int
+	Size            int
+	ShippingCountry string   // Two-letter code of the country prices are quoted for
+	Rarities        []string // Rarity names to restrict results to; empty matches all rarities
+	Sort            string   // Sort option from SortOptions, e.g. "number-asc"; empty keeps the API default order
+}
+
+// Sort fields accepted by the TCGPlayer search API, keyed by the name used in sort options
+var sortFields = map[string]string{
+	"name":         "product-sorting-name",
+	"number":       "number",
+	"release-date": "released-on",
+	"price":        "market-price",
+}
+
+// Sort options accepted in SearchParams.Sort, each a sort field name followed by -asc or -desc
+var SortOptions = []string{
+	"name-asc", "name-desc",
+	"number-asc", "number-desc",
+	"release-date-asc", "release-date-desc",
+	"price-asc", "price-desc",
+}
+
+// Structure for holding API call counts, the result of the schema check, and the error that
+// stopped a paged fetch
+type FetchStats struct {
+	Calls         int   // Number of API calls made
+	ExpectedCalls int   // Minimum number of API calls needed for the requested size
+	SchemaErr     error // Wraps ErrSchemaChange if most fetched products couldn't be parsed, otherwise nil
+	Err           error // Error fetching a page, which stopped the fetch before every product was fetched, otherwise nil
+}
+
+// Exceeded reports whether more API calls were made than the theoretical minimum,
+// indicating retries or empty-tail paging.
+func (fs FetchStats) Exceeded() bool {
+	return fs.Calls > fs.ExpectedCalls
 }
 
 // SearchParams method to update SetName and Size from ValueType set info
@@ -182,8 +291,53 @@ func (sp *SearchParams) UpdateFromSetInfo(set datastore.Set) {
 
 /*-------------------------------------------------------------------------------------------------*/
 
-// Structure for holding custom product attributes
-type customAttrs struct {
-	Number      string `json:"number"`
-	ReleaseDate string `json:"releaseDate"`
+// Names of the custom attribute keys holding a product's number and release date. Each
+// field lists candidate keys in order of preference, since product lines don't agree on
+// attribute naming.
+type attributeKeys struct {
+	Number      []string
+	ReleaseDate []string
+}
+
+// Attribute key names used for product lines without an entry in productLineAttributeKeys.
+var defaultAttributeKeys = attributeKeys{
+	Number:      []string{"number"},
+	ReleaseDate: []string{"releaseDate"},
+}
+
+// Attribute key names registered per product line, keyed by product line url name.
+var productLineAttributeKeys = map[string]attributeKeys{
+	"pokemon": {
+		Number:      []string{"number", "cardNumber", "collectorNumber"},
+		ReleaseDate: []string{"releaseDate", "setReleaseDate"},
+	},
+	"pokemon-japan": {
+		Number:      []string{"number", "cardNumber", "collectorNumber"},
+		ReleaseDate: []string{"releaseDate", "setReleaseDate"},
+	},
+	"magic": {
+		Number:      []string{"number", "collectorNumber"},
+		ReleaseDate: []string{"releaseDate"},
+	},
+	"lorcana-tcg": {
+		Number:      []string{"number", "cardNumber"},
+		ReleaseDate: []string{"releaseDate"},
+	},
+}
+
+// attributeKeysFor returns the attribute key names registered for the product line.
+func attributeKeysFor(productLineUrlName string) attributeKeys {
+	if keys, ok := productLineAttributeKeys[productLineUrlName]; ok {
+		return keys
+	}
+	return defaultAttributeKeys
+}
+
+// Keys of common card attributes, across product lines, that are copied from the raw
+// custom attributes into the queryable 'Attributes' field of a product. Values are
+// copied verbatim since their JSON types differ between product lines.
+var cardAttributeKeys = []string{
+	"description", "flavorText", "cardType", "cardTypeB", "attribute", "monsterType",
+	"attack", "defense", "level", "linkRating", "linkArrows", "color", "convertedCost",
+	"power", "toughness", "subTypes", "hp", "energyType", "stage", "weakness", "resistance",
 }
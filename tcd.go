@@ -4,112 +4,285 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"iter"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gurbos/tcd/datastore"
 	"github.com/gurbos/tcd/tcapi"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
-const CARD_IMAGE_DIR = "/home/gurbos/card_images/" // Directory to store card images
+const (
+	CARD_IMAGE_DIR          = "/home/gurbos/card_images/" // Default directory to store card images
+	IMAGE_FETCH_CONCURRENCY = 8                           // Maximum concurrent image fetches within a single set
+	IMAGE_FETCH_ATTEMPTS    = 3                           // Attempts made to fetch each image before giving up
+	IMAGE_RETRY_BACKOFF     = 2 * time.Second             // Delay before the first image fetch retry, doubled for each retry after
+	PREFLIGHT_TIMEOUT       = 10 * time.Second            // Time allowed for each preflight connectivity check
+	IMAGE_STORE_FILES       = "files"                     // Store product images as files under --image-dir
+	IMAGE_STORE_DB          = "db"                        // Store product images in the product_images table
+	FORMAT_TABLE            = "table"                     // Print products as a table per set
+	DEFAULT_IMAGE_PATH      = "{id}_{suffix}"             // Image file path template, naming files by stored product id
+)
 
 func main() {
 
 	cmdFlags := initCmdFlags()
 
+	// Print build information and exit if version flag is set
+	if cmdFlags.version {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	tcapi.CaptureRawProducts = cmdFlags.capture_raw
+
+	// Validate the requested image size, format, permissions, and store before any work is done
+	imageSpec, err := tcapi.NewImageSpec(cmdFlags.image_size, cmdFlags.image_format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imageFileMode, err := parseFileMode(cmdFlags.image_file_mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imageDirMode, err := parseFileMode(cmdFlags.image_dir_mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tcapi.ValidateSort(cmdFlags.sort); err != nil {
+		log.Fatal(err)
+	}
+	if err := tcapi.ValidateShippingCountry(cmdFlags.shipping_country); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateImagePath(cmdFlags.image_path); err != nil {
+		log.Fatal(err)
+	}
+	if cmdFlags.format != "" && cmdFlags.format != FORMAT_TABLE {
+		log.Fatalf("Invalid --format '%s', must be %s", cmdFlags.format, FORMAT_TABLE)
+	}
+	if _, err := parseProductFields(cmdFlags.fields); err != nil {
+		log.Fatal(err)
+	}
+	if cmdFlags.image_store != IMAGE_STORE_FILES && cmdFlags.image_store != IMAGE_STORE_DB {
+		log.Fatalf("Invalid --image-store '%s', must be %s or %s", cmdFlags.image_store, IMAGE_STORE_FILES, IMAGE_STORE_DB)
+	}
+	var since time.Time
+	if cmdFlags.since != "" {
+		var err error
+		if since, err = time.Parse(time.DateOnly, cmdFlags.since); err != nil {
+			log.Fatalf("Invalid --since '%s', expected a date such as 2024-01-31", cmdFlags.since)
+		}
+	}
+
+	// Create the TCGPlayer API client shared by all requests
+	tcClient := tcapi.NewClient()
+	tcClient.ImageSpec = imageSpec
+	tcClient.SearchTimeout = cmdFlags.search_timeout
+	tcClient.ImageTimeout = cmdFlags.image_timeout
+	if tcClient.Headers, err = parseHeaders(cmdFlags.headers); err != nil {
+		log.Fatal(err)
+	}
+	if err := tcClient.SetProxy(cmdFlags.proxy); err != nil {
+		log.Fatal(err)
+	}
+	if cmdFlags.debug_http {
+		tcClient.EnableDebugLog(log.Default())
+	}
+	if cmdFlags.cache_dir != "" {
+		if err := tcClient.EnableCache(cmdFlags.cache_dir, cmdFlags.cache_ttl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Serve scrape metrics if metrics-addr flag is set
+	if cmdFlags.metrics_addr != "" {
+		startMetricsServer(cmdFlags.metrics_addr)
+	}
+
+	// Cancel the scrape on interrupt or termination so workers can drain their channels
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Load DB credentials from environment variables
 	var creds DBCredentials
 	creds.LoadCredentials()
-	config := datastore.Config(creds.ConnectString())
+	config := datastore.Config(creds.ConnectString(), cmdFlags.conn_lifetime_jitter)
+
+	// Test the database connection and exit if check-db flag is set
+	if cmdFlags.check_db {
+		target := fmt.Sprintf("%s@%s:%d/%s", config.ConnConfig.User, config.ConnConfig.Host,
+			config.ConnConfig.Port, config.ConnConfig.Database)
+		if err := checkDatabase(ctx, config); err != nil {
+			fmt.Fprintf(os.Stderr, "Database check failed for %s: %v\n", target, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Database check succeeded for %s\n", target)
+		os.Exit(0)
+	}
 
 	// Print product lines and exit if product-lines flag is set
 	if cmdFlags.product_lines {
-		pls := tcapi.FetchProductLines()
-		printLists(pls)
+		pls := tcClient.FetchProductLines()
+		printLists(os.Stdout, pls, cmdFlags.filter)
 		os.Exit(0)
 	}
 
-	if cmdFlags.product_line_name != "" {
-		productLine := tcapi.FetchProductLineByName(strings.ToLower(cmdFlags.product_line_name)) // Fetch product line info by name
+	// Print the filter values of the pl product line and exit if list-aggregations flag is set
+	if cmdFlags.list_aggregations {
+		productLine := tcClient.FetchProductLineByName(cmdFlags.pl)
 		if productLine == nil {
-			log.Fatalf("Product line '%s' not found", cmdFlags.product_line_name)
+			log.Fatal(productLineNotFoundError(cmdFlags.pl, tcClient.FetchProductLines()))
 		}
+		printAggregations(os.Stdout, tcClient.FetchAggregations(productLine.UrlName), cmdFlags.filter)
+		os.Exit(0)
+	}
 
-		if cmdFlags.write_data {
-			pool, err := datastore.NewDBPool(context.Background(), config) // Create DB connection pool
+	// Audit stored custom attributes and exit if audit-attributes flag is set
+	if cmdFlags.audit_attributes {
+		pool, err := datastore.NewDBPool(ctx, config) // Create DB connection pool
+		if err != nil {
+			log.Fatal(fmt.Errorf("Error creating DB connection pool: %w", err))
+		}
+		store := datastore.NewPostgresDataStore(pool, 0) // Audit scans every product, so no query timeout
+		scanned, failed, err := auditAttributes(ctx, store)
+		store.Close()
+		if err != nil {
+			log.Fatal(fmt.Errorf("Error auditing custom attributes: %w", err))
+		}
+		fmt.Printf("Audited %d products, %d with invalid custom attributes\n", scanned, failed)
+		os.Exit(0)
+	}
+
+	if len(cmdFlags.product_line_names) > 0 {
+		// Fetch product line info by name, failing before any work is done if a name is unknown
+		productLines := make([]*datastore.Product_Line, 0, len(cmdFlags.product_line_names))
+		for _, name := range cmdFlags.product_line_names {
+			productLine := tcClient.FetchProductLineByName(name)
+			if productLine == nil {
+				log.Fatal(productLineNotFoundError(name, tcClient.FetchProductLines()))
+			}
+			productLines = append(productLines, productLine)
+		}
+
+		// Print pre-scrape product counts and exit if count-only flag is set
+		if cmdFlags.count_only {
+			for _, productLine := range productLines {
+				printSetCounts(ctx, tcClient, productLine, cmdFlags.product_type)
+			}
+			os.Exit(0)
+		}
+
+		// Print the products of each set and exit if format flag is set
+		if cmdFlags.format != "" {
+			for _, productLine := range productLines {
+				if err := printProductLine(ctx, tcClient, productLine, cmdFlags); err != nil {
+					log.Fatal(err)
+				}
+			}
+			os.Exit(0)
+		}
+
+		// Update stored set counts and exit if refresh-counts flag is set
+		if cmdFlags.refresh_counts {
+			pool, err := datastore.NewDBPool(ctx, config) // Create DB connection pool
 			if err != nil {
 				log.Fatal(fmt.Errorf("Error creating DB connection pool: %w", err))
 			}
-			defer pool.Close()
-			store := datastore.NewPostgresDataStore(pool) // Create DataStore
-
-			// Add Product Line to the database
-			productLine, err = store.AddProductLine(context.Background(), productLine)
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) {
-				switch pgErr.Code {
-				case datastore.UniqueViolationError:
-					*productLine, err = store.GetProductLineByName(context.Background(), productLine.UrlName)
-				default:
-					log.Fatal(fmt.Errorf("Error adding Product Line: %w", err))
+			store := datastore.NewPostgresDataStore(pool, cmdFlags.query_timeout)
+			for _, productLine := range productLines {
+				updated, err := refreshSetCounts(ctx, tcClient, store, productLine, cmdFlags.product_type)
+				if err != nil {
+					store.Close()
+					log.Fatal(fmt.Errorf("Error refreshing set counts of product line '%s': %w", productLine.Name, err))
 				}
+				fmt.Printf("Updated the counts of %d sets of product line '%s'\n", updated, productLine.Name)
 			}
+			store.Close()
+			os.Exit(0)
+		}
 
-			// Initialize worker pool configuration struct and launch worker pool
-			maxProcs := runtime.GOMAXPROCS(0) / 3 // Determine number of workers to use
-			wpConf := NewWorkerPoolConfig(
-				context.Background(),
-				maxProcs,                                   // pool size
-				make(chan DataContext, maxProcs*10),        // data context channel
-				make(chan Job, maxProcs*3),                 // job channel
-				make(chan JobStatus, maxProcs*3),           // job status channel
-				make(chan []datastore.Product, maxProcs*3), // image data request channel
-				store,
-			)
-
-			sets, err := getSetsNotInDatastore(productLine, store)
+		if cmdFlags.write_data {
+			pool, err := datastore.NewDBPool(context.Background(), config) // Create DB connection pool
 			if err != nil {
-				log.Fatal(fmt.Errorf("Error fetching sets for product line '%s': %w", productLine.Name, err))
+				log.Fatal(fmt.Errorf("Error creating DB connection pool: %w", err))
 			}
+			store := datastore.NewPostgresDataStore(pool, cmdFlags.query_timeout) // Create DataStore
+			store.SetBatchSize(cmdFlags.batch_size)
+			defer store.Close()
 
-			// If no new sets are found, log a message and exit the program
-			if len(sets) == 0 {
-				log.Printf("No new sets found for product line '%s', exiting program.", productLine.Name)
-				os.Exit(0)
+			// Verify the database and API are reachable before scraping
+			if err := preflightCheck(ctx, tcClient, store); err != nil {
+				log.Fatal(fmt.Errorf("Preflight check failed: %w", err))
 			}
 
-			// Associate sets with the product line and add to the database
-			associateSetsWithProductLine(sets, productLine.Id)
+			if cmdFlags.resume && (!cmdFlags.upsert || cmdFlags.sort == "") {
+				log.Printf("Warning: --resume only skips completely stored sets; fetching the new products of sets " +
+					"that grew since they were stored also needs --upsert and a non-empty --sort")
+			}
+			if cmdFlags.workers < 0 {
+				log.Fatalf("Invalid --workers %d, must be 0 (GOMAXPROCS/3) or greater", cmdFlags.workers)
+			}
+			if min(cmdFlags.data_workers, cmdFlags.job_workers, cmdFlags.image_workers) < 0 {
+				log.Fatalf("Invalid --data-workers, --job-workers, or --image-workers, must be 0 (derived from --workers) or greater")
+			}
 
-			// Launch the worker pool
-			LaunchWorkerPool(wpConf)
+			opts := scrapeOptions{
+				flags:  cmdFlags,
+				client: tcClient,
+				since:  since,
+				imageOpts: ImageOptions{
+					force:    cmdFlags.force_images,
+					resume:   cmdFlags.resume,
+					client:   tcClient,
+					spec:     imageSpec,
+					fileMode: imageFileMode,
+					dirMode:  imageDirMode,
+					store:    cmdFlags.image_store,
+					dir:      cmdFlags.image_dir,
+					path:     cmdFlags.image_path,
+				},
+			}
 
-			// Send data contexts to data context channel
-			for _, set := range sets {
-				sParams := tcapi.NewSearchParams(
-					productLine.UrlName,
-					set.UrlName,
-					"Cards", 0,
-					set.Count)
-				dataCtx := DataContext{
-					searchParams: sParams,
-					set:          set,
-					productLine:  *productLine,
+			// Record the products written for each set if audit-log flag is set
+			if cmdFlags.audit_log != "" {
+				opts.auditLog, err = openAuditLog(cmdFlags.audit_log)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer opts.auditLog.Close()
+			}
+
+			// Scrape each product line in turn; a failure on one product line doesn't abort the others
+			summaries := make([]string, 0, len(productLines))
+			for _, productLine := range productLines {
+				if ctx.Err() != nil {
+					summaries = append(summaries, fmt.Sprintf("%s: not processed, scrape canceled", productLine.Name))
+					continue
+				}
+				summary, err := scrapeProductLine(ctx, store, productLine, opts)
+				if err != nil {
+					log.Printf("Error scraping product line '%s': %v", productLine.Name, err)
+					summaries = append(summaries, fmt.Sprintf("%s: failed: %v", productLine.Name, err))
+					if cmdFlags.fail_fast {
+						if !cmdFlags.quiet {
+							printSummaries(summaries)
+						}
+						os.Exit(1)
+					}
+					continue
 				}
-				wpConf.dataCtxChan <- dataCtx // Send data context to data context channel
+				summaries = append(summaries, fmt.Sprintf("%s: %s", productLine.Name, summary))
 			}
 
-			close(wpConf.dataCtxChan)     // Close data context channel to signal data workers no more data contexts will be sent
-			wpConf.dataWaitGroup.Wait()   // Wait for all data workers to finish
-			close(wpConf.jobsChan)        // Close job channel to signal workers no more jobs will be sent
-			wpConf.jobWaitGroup.Wait()    // Wait for all job workers to finish
-			close(wpConf.jobStatChan)     // Close error channel to signal error worker no more errors will be sent
-			wpConf.statusWaitGroup.Wait() // Wait for status worker to finish
-			close(wpConf.imgInfoChan)     // Close image info channel to signal image worker no more image requests will be sent
-			wpConf.imageWaitGroup.Wait()  // Wait for image worker to finish
+			if !cmdFlags.quiet {
+				printSummaries(summaries)
+			}
 
 			fmt.Println("All workers finished, exiting program.")
 			os.Exit(0)
@@ -117,3 +290,286 @@ func main() {
 
 	}
 }
+
+// printSummaries prints the final summary of each product line scraped, followed by the totals
+// across all product lines.
+func printSummaries(summaries []string) {
+	for _, summary := range summaries {
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	fmt.Fprint(os.Stderr, runSummary())
+}
+
+// scrapeOptions holds the settings shared by the scrape of every product line.
+type scrapeOptions struct {
+	flags     *cmd_flags
+	client    *tcapi.Client
+	imageOpts ImageOptions
+	auditLog  *auditLog // Records the products written for each set, nil if disabled
+	since     time.Time // Only sets released after since are scraped, unless zero
+}
+
+// scrapeProductLine adds the product line and its new sets to the data store, then runs the worker
+// pool over those sets. It returns the final progress summary for the product line.
+func scrapeProductLine(ctx context.Context, store *datastore.PostgresDataStore, productLine *datastore.Product_Line,
+	opts scrapeOptions) (string, error) {
+	cmdFlags := opts.flags
+
+	// Add Product Line to the database
+	productLine, err := store.AddProductLine(context.Background(), productLine)
+	if errors.Is(err, datastore.ErrDuplicate) {
+		*productLine, err = store.GetProductLineByName(context.Background(), productLine.UrlName)
+		if err != nil {
+			return "", fmt.Errorf("Error fetching existing Product Line: %w", err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("Error adding Product Line: %w", err)
+	}
+
+	// Scrape every set of the product line if upsert flag is set, otherwise only sets not yet stored
+	var sets []datastore.Set
+	if cmdFlags.upsert {
+		sets = opts.client.FetchSetsByProductLine(productLine.UrlName, cmdFlags.product_type)
+	} else {
+		sets, err = getSetsNotInDatastore(opts.client, productLine, cmdFlags.product_type, store)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error fetching sets for product line '%s': %w", productLine.Name, err)
+	}
+
+	// Keep only the named set if set flag is set
+	if cmdFlags.set != "" {
+		sets = filterSetsByUrlName(sets, cmdFlags.set)
+		if len(sets) == 0 && cmdFlags.upsert {
+			return "", fmt.Errorf("Set '%s' doesn't exist in product line '%s'", cmdFlags.set, productLine.Name)
+		}
+		if len(sets) == 0 {
+			return "", fmt.Errorf("Set '%s' is not a new set of product line '%s', "+
+				"either it doesn't exist in the product line or it is already stored", cmdFlags.set, productLine.Name)
+		}
+	}
+
+	// Keep only sets released after the since flag date if it is set
+	if !opts.since.IsZero() {
+		sets, err = filterSetsReleasedAfter(opts.client, productLine, sets, cmdFlags.product_type, opts.since)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// If no new sets are found, there is nothing to scrape for this product line
+	if len(sets) == 0 {
+		log.Printf("No new sets found for product line '%s'.", productLine.Name)
+		return "no new sets", nil
+	}
+
+	// Cap the number of sets processed if limit flag is set
+	if cmdFlags.limit < 0 {
+		return "", fmt.Errorf("Invalid --limit %d, must be 0 (no limit) or greater", cmdFlags.limit)
+	}
+	if cmdFlags.limit > 0 && cmdFlags.limit < len(sets) {
+		sets = sets[:cmdFlags.limit]
+	}
+
+	// Associate sets with the product line. Sets are stored by the job workers along with their
+	// products, so a set is never stored without them
+	associateSetsWithProductLine(sets, productLine.Id)
+
+	// Stop at the first failed set if fail-fast flag is set
+	var failFast context.CancelCauseFunc
+	if cmdFlags.fail_fast {
+		ctx, failFast = context.WithCancelCause(ctx)
+		defer failFast(nil)
+	}
+
+	// Initialize worker pool configuration struct and launch worker pool
+	maxProcs := poolSize(cmdFlags.workers) // Determine number of workers to use
+	wpConf := NewWorkerPoolConfig(
+		ctx,
+		maxProcs,                            // pool size
+		make(chan DataContext, maxProcs*10), // data context channel
+		make(chan Job, maxProcs*3),          // job channel
+		make(chan JobStatus, maxProcs*3),    // job status channel
+		make(chan []datastore.Product, maxProcs*3), // image data request channel
+		store,
+		NewProgress(len(sets)), // progress counters
+	)
+
+	// Override the worker count of each stage if its flag is set
+	if cmdFlags.data_workers > 0 {
+		wpConf.dataWorkers = cmdFlags.data_workers
+	}
+	if cmdFlags.job_workers > 0 {
+		wpConf.jobWorkers = cmdFlags.job_workers
+	}
+	if cmdFlags.image_workers > 0 {
+		wpConf.imageWorkers = cmdFlags.image_workers
+	}
+
+	wpConf.setLineFormat = setLineFormat(sets) // Size status output columns to fit the sets
+	wpConf.exactSetName = cmdFlags.exact_set_name
+	wpConf.upsert = cmdFlags.upsert
+	wpConf.failFast = failFast
+	wpConf.auditLog = opts.auditLog
+	wpConf.client = opts.client
+	wpConf.imageOpts = opts.imageOpts
+
+	// Launch the worker pool
+	pool := LaunchWorkerPool(wpConf)
+
+	// Launch the progress reporter unless quiet mode is set
+	if !cmdFlags.quiet {
+		wpConf.progress.Start(os.Stderr, PROGRESS_INTERVAL)
+	}
+
+	// Send data contexts to data context channel as the workers make room for them. Each
+	// data context is built only when it can be sent, and sending stops if the scrape is canceled.
+	enqueued := 0
+	for dataCtx := range setDataContexts(*productLine, sets, cmdFlags) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Skip sets already scraped by an interrupted run if resume flag is set
+		if cmdFlags.resume {
+			scraped, stored, storedCount, err := setAlreadyScraped(ctx, store, dataCtx.set)
+			if err != nil {
+				log.Printf("Error checking whether set '%s' was scraped: %v", dataCtx.set.Name, err)
+			} else if scraped {
+				log.Printf("Skipping already scraped set '%s'", dataCtx.set.Name)
+				enqueued++
+				wpConf.progress.SetCompleted(0)
+				continue
+			} else if storedCount > 0 && cmdFlags.upsert && cmdFlags.sort != "" {
+				// Fetch only the products after those already stored. A set and its products are
+				// written in one transaction, so an interrupted set stores none and is fetched from
+				// the start; a stored count short of the set count means the set grew upstream.
+				// Screening only removes products, so the stored count never skips past an unstored
+				// product, and the upsert tolerates refetching stored ones. Offsets need the stable
+				// order of a sort to line up.
+				log.Printf("Resuming set '%s' from product %d of %d", dataCtx.set.Name, storedCount, dataCtx.set.Count)
+				dataCtx.searchParams.From = storedCount
+				dataCtx.set.ReleaseDate, dataCtx.set.ReleasedOn = stored.ReleaseDate, stored.ReleasedOn
+			}
+		}
+
+		if !sendDataContext(ctx, wpConf.dataCtxChan, dataCtx) {
+			break
+		}
+		enqueued++
+	}
+	for range sets[enqueued:] {
+		wpConf.progress.SetNotProcessed() // Record sets never enqueued due to cancellation
+	}
+
+	pool.Shutdown() // Wait for the enqueued sets to be processed, or for workers to stop on cancellation
+
+	failedSets := wpConf.progress.FailedSets()
+	if ctx.Err() != nil && (!cmdFlags.fail_fast || len(failedSets) == 0) {
+		log.Printf("Scrape canceled, remaining sets of product line '%s' were not processed.", productLine.Name)
+	}
+
+	if !cmdFlags.quiet {
+		wpConf.progress.Stop() // Stop the progress reporter
+	}
+
+	// Report images that could not be downloaded after all retries
+	if failed := wpConf.progress.FailedImages(); len(failed) > 0 {
+		log.Printf("Images for %d products of product line '%s' could not be downloaded, product ids: %v",
+			len(failed), productLine.Name, failed)
+	}
+
+	// Report sets that could not be written
+	if len(failedSets) > 0 {
+		log.Printf("%d sets of product line '%s' failed:\n  %s", len(failedSets), productLine.Name, strings.Join(failedSets, "\n  "))
+	}
+	if cmdFlags.fail_fast && len(failedSets) > 0 {
+		return "", fmt.Errorf("stopped at the first failed set, remaining sets were not processed: %w", context.Cause(ctx))
+	}
+	return wpConf.progress.Summary(), nil
+}
+
+// printProductLine fetches the products of each set of productLine, limited by the set and limit
+// flags, and prints them to stdout in the output format, without writing them to the database.
+func printProductLine(ctx context.Context, client *tcapi.Client, productLine *datastore.Product_Line, cmdFlags *cmd_flags) error {
+	fields, err := parseProductFields(cmdFlags.fields)
+	if err != nil {
+		return err
+	}
+	sets := client.FetchSetsByProductLine(productLine.UrlName, cmdFlags.product_type)
+	if cmdFlags.set != "" {
+		sets = filterSetsByUrlName(sets, cmdFlags.set)
+		if len(sets) == 0 {
+			return fmt.Errorf("Set '%s' doesn't exist in product line '%s'", cmdFlags.set, productLine.Name)
+		}
+	}
+	if cmdFlags.limit < 0 {
+		return fmt.Errorf("Invalid --limit %d, must be 0 (no limit) or greater", cmdFlags.limit)
+	}
+	if cmdFlags.limit > 0 && cmdFlags.limit < len(sets) {
+		sets = sets[:cmdFlags.limit]
+	}
+
+	for dataCtx := range setDataContexts(*productLine, sets, cmdFlags) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		products, stats := client.FetchProductsInParts(ctx, dataCtx.searchParams)
+		if stats.Err != nil {
+			log.Printf("Skipping set '%s': %v", dataCtx.set.Name, stats.Err)
+			continue
+		}
+		if cmdFlags.exact_set_name {
+			products, _ = filterProductsBySetUrlName(products, dataCtx.set.UrlName)
+		}
+		products, _, _ = screenProducts(products)
+		printProductTable(os.Stdout, dataCtx.set, products, fields)
+	}
+	return nil
+}
+
+// setDataContexts returns a sequence of the data contexts for scraping each of sets from
+// productLine, in order. Each data context is built as the sequence is iterated.
+func setDataContexts(productLine datastore.Product_Line, sets []datastore.Set, cmdFlags *cmd_flags) iter.Seq[DataContext] {
+	return func(yield func(DataContext) bool) {
+		for _, set := range sets {
+			sParams := tcapi.NewSearchParams(
+				productLine.UrlName,
+				set.UrlName,
+				cmdFlags.product_type, 0,
+				set.Count)
+			sParams.Sort = cmdFlags.sort
+			sParams.Rarities = cmdFlags.rarities
+			sParams.ShippingCountry = cmdFlags.shipping_country
+			dataCtx := DataContext{
+				searchParams: sParams,
+				set:          set,
+				productLine:  productLine,
+			}
+			if !yield(dataCtx) {
+				return
+			}
+		}
+	}
+}
+
+// sendDataContext sends dataCtx on dcChan, blocking while the channel is full. It returns
+// false without sending if ctx is canceled first.
+func sendDataContext(ctx context.Context, dcChan chan<- DataContext, dataCtx DataContext) bool {
+	select {
+	case dcChan <- dataCtx:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// poolSize returns the number of workers to launch: workers if set, otherwise a third of
+// GOMAXPROCS. There is no API rate limiter, so each data worker adds a concurrent stream of
+// TCGPlayer API requests.
+func poolSize(workers int) int {
+	if workers > 0 {
+		return workers
+	}
+	return max(runtime.GOMAXPROCS(0)/3, 1)
+}
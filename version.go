@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Build information, set at build time with:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"     // Release version
+	commit    = "unknown" // Git commit the binary was built from
+	buildDate = "unknown" // UTC build timestamp
+)
+
+// versionString returns the build information printed by the version flag.
+func versionString() string {
+	return fmt.Sprintf("tcd %s (commit %s, built %s)", version, commit, buildDate)
+}